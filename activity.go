@@ -2,26 +2,40 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type Activity struct {
-	target  int
-	aliases map[string]*alias
+	target   int
+	sent     int
+	aliases  map[string]*alias
+	rate     time.Duration
+	min      int
+	max      int
+	paused   bool
+	recorder *Recorder
+	mu       sync.Mutex
 }
 
 func NewActivity(n int, aliases map[string]*alias) *Activity {
 	return &Activity{
 		target:  n,
 		aliases: aliases,
+		rate:    ACTIVITY_RATE,
+		min:     MIN_INVOICE,
+		max:     MAX_INVOICE,
 	}
 }
 
 const MIN_INVOICE = 1
 const MAX_INVOICE = 12000
+const ACTIVITY_RATE = 2000 * time.Millisecond
 
 func (a *Activity) Run() {
 	go (func() {
@@ -31,8 +45,13 @@ func (a *Activity) Run() {
 			indexedAliases = append(indexedAliases, o)
 		}
 
-		for i := 0; i < a.target; i++ {
-			time.Sleep(2000 * time.Millisecond)
+		a.showStatus()
+		for {
+			time.Sleep(a.interval())
+			amt, ok := a.next()
+			if !ok {
+				continue
+			}
 			srcindex := rand.Intn(len(a.aliases))
 			var destindex int
 			for {
@@ -44,27 +63,197 @@ func (a *Activity) Run() {
 			src := indexedAliases[srcindex]
 			dest := indexedAliases[destindex]
 
-			destrpc := grpcClient(dest)
-
-			ctx := context.Background()
-			destInvResp, err := destrpc.AddInvoice(ctx, &lnrpc.Invoice{
-				Value: int64(rand.Intn(MAX_INVOICE) + MIN_INVOICE),
-				Memo:  fmt.Sprintf("random invoice from %s, to %s", *src.Name, *dest.Name),
-			})
-			if err != nil {
-				continue
+			memo := fmt.Sprintf("random invoice from %s, to %s", *src.Name, *dest.Name)
+			a.mu.Lock()
+			recorder := a.recorder
+			a.mu.Unlock()
+			if recorder != nil {
+				recorder.record(src, dest, amt, memo, PAYMENT_INVOICE)
 			}
+			pay(src, dest, amt, memo)
+			a.showStatus()
+		}
 
-			srcrpc := grpcClient(src)
+	})()
+}
 
-			_, err = srcrpc.SendPaymentSync(ctx, &lnrpc.SendRequest{
-				PaymentRequest: destInvResp.PaymentRequest,
-			})
-			if err != nil {
-				continue
-			}
+// pay has dest create an invoice and src pay it
+func pay(src, dest *alias, amt int, memo string) error {
+	destrpc := grpcClient(dest)
+	if destrpc == nil {
+		return fmt.Errorf("cannot connect to %s", *dest.Name)
+	}
+
+	ctx := context.Background()
+	destInvResp, err := destrpc.AddInvoice(ctx, &lnrpc.Invoice{
+		Value: int64(amt),
+		Memo:  memo,
+	})
+	if err != nil {
+		return err
+	}
+
+	srcrpc := grpcClient(src)
+	if srcrpc == nil {
+		return fmt.Errorf("cannot connect to %s", *src.Name)
+	}
+
+	resp, err := srcrpc.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		PaymentRequest: destInvResp.PaymentRequest,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.PaymentError != "" {
+		return errors.New(resp.PaymentError)
+	}
+	return nil
+}
+
+// next claims the next payment if activity is running and returns a random
+// amount within the current range
+func (a *Activity) next() (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.paused || a.sent >= a.target {
+		return 0, false
+	}
+	a.sent++
+	return rand.Intn(a.max-a.min+1) + a.min, true
+}
+
+func (a *Activity) interval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+func (a *Activity) state() string {
+	switch {
+	case a.sent >= a.target:
+		return "idle"
+	case a.paused:
+		return "paused"
+	}
+	return "running"
+}
 
+func (a *Activity) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := fmt.Sprintf("activity: %s %d/%d every %s, %d-%d sat", a.state(), a.sent, a.target, a.rate, a.min, a.max)
+	if a.recorder != nil {
+		status += ", " + a.recorder.String()
+	}
+	return status
+}
+
+// Record starts writing every generated payment to path, an empty path stops
+// recording
+func (a *Activity) Record(path string) error {
+	var r *Recorder
+	if path != "" {
+		var err error
+		r, err = NewRecorder(path)
+		if err != nil {
+			return err
 		}
+	}
+	a.mu.Lock()
+	old := a.recorder
+	a.recorder = r
+	a.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
 
-	})()
+func (a *Activity) showStatus() {
+	ui.setStatus("activity", a.String())
+	app.Draw()
+}
+
+func (a *Activity) TogglePause() {
+	a.mu.Lock()
+	a.paused = !a.paused
+	a.mu.Unlock()
+	a.showStatus()
+}
+
+func activityCommand(args []string) string {
+	if act == nil {
+		return "activity not started"
+	}
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+
+	a := act
+	a.mu.Lock()
+	switch args[0] {
+	case "status":
+	case "pause":
+		a.paused = true
+	case "resume":
+		a.paused = false
+	case "stop":
+		a.target = a.sent
+		a.paused = false
+	case "rate":
+		if len(args) != 2 {
+			a.mu.Unlock()
+			return "usage: rate <duration>, e.g. rate 500ms"
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			a.mu.Unlock()
+			return fmt.Sprintf("invalid rate %s", args[1])
+		}
+		a.rate = d
+	case "amount":
+		if len(args) != 3 {
+			a.mu.Unlock()
+			return "usage: amount <min> <max>"
+		}
+		min, err1 := strconv.Atoi(args[1])
+		max, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil || min < 1 || max < min {
+			a.mu.Unlock()
+			return fmt.Sprintf("invalid amount range %s-%s", args[1], args[2])
+		}
+		a.min = min
+		a.max = max
+	case "record":
+		a.mu.Unlock()
+		if len(args) != 2 {
+			return "usage: record <file>|off"
+		}
+		path := args[1]
+		if path == "off" {
+			path = ""
+		}
+		if err := a.Record(path); err != nil {
+			return err.Error()
+		}
+		a.mu.Lock()
+	case "add":
+		if len(args) != 2 {
+			a.mu.Unlock()
+			return "usage: add <n>"
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			a.mu.Unlock()
+			return fmt.Sprintf("invalid payment count %s", args[1])
+		}
+		a.target += n
+	default:
+		a.mu.Unlock()
+		return fmt.Sprintf("unknown activity command %s", args[0])
+	}
+	a.mu.Unlock()
+
+	a.showStatus()
+	return a.String()
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agent is what the background agents share, chaos, churn, the miner and the
+// fee market. It runs their loops until stopped, mu also guards the settings
+// of the agent embedding it
+type agent struct {
+	running bool
+	stop    chan struct{}
+	mu      sync.Mutex
+}
+
+// backgroundAgent is an agent driven from the cli with key=value settings
+type backgroundAgent interface {
+	Start()
+	Stop()
+	String() string
+	set(key, value string) error
+	showStatus()
+}
+
+// start runs each loop in its own goroutine until the agent is stopped, it
+// is false when the agent already runs
+func (a *agent) start(loops ...func(stop chan struct{})) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running {
+		return false
+	}
+	a.running = true
+	a.stop = make(chan struct{})
+	for _, loop := range loops {
+		go loop(a.stop)
+	}
+	return true
+}
+
+func (a *agent) halt() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running {
+		close(a.stop)
+		a.running = false
+	}
+}
+
+func (a *agent) isRunning() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.running
+}
+
+// repeat calls tick after every wait until stop is closed, wait is asked
+// again each time so new settings apply to the next round
+func repeat(stop chan struct{}, wait func() time.Duration, tick func()) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait()):
+		}
+		tick()
+	}
+}
+
+func showAgentStatus(key string, s fmt.Stringer) {
+	ui.setStatus(key, s.String())
+	app.Draw()
+}
+
+// agentCommand applies the key=value settings after the subcommand, then
+// starts, stops or shows the agent
+func agentCommand(kind string, a backgroundAgent, args []string) error {
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid setting %s, expected key=value", arg)
+		}
+		if err := a.set(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "start":
+		a.Start()
+	case "stop":
+		a.Stop()
+	case "set", "status":
+		a.showStatus()
+	default:
+		return fmt.Errorf("unknown %s command %s", kind, args[0])
+	}
+	return nil
+}
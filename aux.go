@@ -4,10 +4,15 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -28,9 +33,18 @@ type cfgview struct {
 	Rpc      int
 	Rest     int
 	Listen   int
+	Tower    int
 	Name     string
 	Macaroon string
 	User     string
+	RPCUser  string
+	RPCPass  string
+	Backend  *Backend
+
+	Watchtower bool
+	Wtclient   bool
+	ScidAlias  bool
+	ZeroConf   bool
 }
 
 type Logger struct {
@@ -73,26 +87,50 @@ bitcoin.active=1
 bitcoin.node=bitcoind
 
 [Bitcoind]
-bitcoind.rpcuser=kek
-bitcoind.rpcpass=kek
-bitcoind.zmqpubrawblock=tcp://127.0.0.1:28332
-bitcoind.zmqpubrawtx=tcp://127.0.0.1:28333
-`
-
+bitcoind.rpchost=localhost:{{.Backend.RPCPort}}
+bitcoind.rpcuser={{.RPCUser}}
+bitcoind.rpcpass={{.RPCPass}}
+bitcoind.zmqpubrawblock=tcp://127.0.0.1:{{.Backend.ZMQBlock}}
+bitcoind.zmqpubrawtx=tcp://127.0.0.1:{{.Backend.ZMQTx}}
+{{if .Watchtower}}
+[Watchtower]
+watchtower.active=true
+watchtower.listen=localhost:{{.Tower}}
+{{end}}{{if .Wtclient}}
+[Wtclient]
+wtclient.active=true
+{{end}}{{if .ScidAlias}}
+[protocol]
+protocol.option-scid-alias=true
+{{if .ZeroConf}}protocol.zero-conf=true
+{{end}}{{end}}`
+
+// bitcoinconf keeps rpc and zmq settings global before 0.17, later versions
+// only apply them to the network named in a section
 const bitcoinconf = `server=1
 txindex=1
 daemon=1
 regtest=1
-maxconnections=10
-rpcuser=kek
-rpcpassword=kek
+datadir={{.Datadir}}
+{{if .Sections}}
+[regtest]
+{{end}}maxconnections=10
+dnsseed=0
+discover=0
+port={{.P2PPort}}
+{{range .Peers}}addnode={{.}}
+{{end}}rpcuser={{.RPCUser}}
+rpcpassword={{.RPCPass}}
+rpcport={{.RPCPort}}
 minrelaytxfee=0.00000000
 incrementalrelayfee=0.00000010
-zmqpubrawblock=tcp://127.0.0.1:28332
-zmqpubrawtx=tcp://127.0.0.1:28333
-datadir={{.}}/.lndev/bitcoin
+{{if .FallbackFee}}fallbackfee=0.00010000
+{{end}}zmqpubrawblock=tcp://127.0.0.1:{{.ZMQBlock}}
+zmqpubrawtx=tcp://127.0.0.1:{{.ZMQTx}}
 `
 
+// node is what the cli keeps per node, Buff is its output as markup with
+// the command output escaped
 type node struct {
 	Buff     string
 	Cmds     []string
@@ -115,6 +153,39 @@ func (a *alias) Command(c ...string) *exec.Cmd {
 
 }
 
+// index is the N of the node's ~/.lndev/userN directory
+func (a *alias) index() int {
+	return a.Port - BASE_PORT
+}
+
+// channelPoint parses a txid:index channel point as shown by listchannels
+func channelPoint(s string) (*lnrpc.ChannelPoint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid channel point %s", s)
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel point %s", s)
+	}
+	return &lnrpc.ChannelPoint{
+		FundingTxid: &lnrpc.ChannelPoint_FundingTxidStr{FundingTxidStr: parts[0]},
+		OutputIndex: uint32(index),
+	}, nil
+}
+
+// fundingTxid returns the txid of a channel point in the usual reversed hex
+func fundingTxid(p *lnrpc.ChannelPoint) string {
+	if s := p.GetFundingTxidStr(); s != "" {
+		return s
+	}
+	hash, err := chainhash.NewHash(p.GetFundingTxidBytes())
+	if err != nil {
+		return ""
+	}
+	return hash.String()
+}
+
 func sortAliasKeys(a map[string]*alias) []string {
 	keys := make([]string, 0, len(a))
 
@@ -149,4 +220,34 @@ func ensureDir(dir string) {
 	}
 }
 
+// copyDir copies a directory tree, used to snapshot a node's datadir while
+// the node is stopped
+func copyDir(src, dest string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
+
 const BASE_PORT = 10000
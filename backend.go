@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Backend is one regtest bitcoind. The first holds the wallet that mines and
+// funds the network, the others are peered with it so lnd nodes assigned to
+// them can fall behind or follow a different chain when they are partitioned
+type Backend struct {
+	N        int
+	Datadir  string
+	RPCPort  int
+	P2PPort  int
+	ZMQBlock int
+	ZMQTx    int
+	rpc      *BitcoinRPC
+}
+
+var backends []*Backend
+
+// lnd node name to the backend it uses
+var assigned = make(map[string]int)
+var assignedMu sync.Mutex
+
+// groups of backends that can reach each other, nil while all are joined
+var partition [][]int
+var partitionMu sync.Mutex
+
+const BACKEND_PORT_STEP = 10
+const BITCOIN_P2P_PORT = 18444
+const ZMQ_BLOCK_PORT = 28332
+const ZMQ_TX_PORT = 28333
+
+// NewBackends lays out n backends, the first keeps the ports and datadir a
+// single bitcoind always had
+func NewBackends(n int) []*Backend {
+	if n < 1 {
+		n = 1
+	}
+	list := make([]*Backend, n)
+	for i := range list {
+		b := &Backend{
+			N:        i,
+			Datadir:  fmt.Sprintf("%s/.lndev/bitcoin", userdir),
+			RPCPort:  BITCOIN_RPC_PORT + i*BACKEND_PORT_STEP,
+			P2PPort:  BITCOIN_P2P_PORT + i*BACKEND_PORT_STEP,
+			ZMQBlock: ZMQ_BLOCK_PORT + i*BACKEND_PORT_STEP,
+			ZMQTx:    ZMQ_TX_PORT + i*BACKEND_PORT_STEP,
+			rpc:      btc,
+		}
+		if i > 0 {
+			b.Datadir = fmt.Sprintf("%s/.lndev/bitcoin%d", userdir, i)
+			b.rpc = NewBitcoinRPC(fmt.Sprintf("http://127.0.0.1:%d", b.RPCPort), BITCOIN_RPC_USER, BITCOIN_RPC_PASS)
+		}
+		list[i] = b
+	}
+	return list
+}
+
+func (b *Backend) String() string {
+	if b.N == 0 {
+		return "Regtest"
+	}
+	return fmt.Sprintf("Regtest%d", b.N)
+}
+
+func (b *Backend) conf() string {
+	return b.Datadir + "/bitcoin.conf"
+}
+
+func (b *Backend) addr() string {
+	return fmt.Sprintf("127.0.0.1:%d", b.P2PPort)
+}
+
+// writeConf writes bitcoin.conf, each backend connects out to the ones after
+// it so every pair has exactly one connection to cut when partitioning
+func (b *Backend) writeConf() error {
+	ensureDir(b.Datadir)
+	view := &btcview{
+		Datadir:  b.Datadir,
+		RPCUser:  BITCOIN_RPC_USER,
+		RPCPass:  BITCOIN_RPC_PASS,
+		RPCPort:  b.RPCPort,
+		P2PPort:  b.P2PPort,
+		ZMQBlock: b.ZMQBlock,
+		ZMQTx:    b.ZMQTx,
+		Version:  bitcoindVersion,
+	}
+	for _, peer := range backends[b.N+1:] {
+		view.Peers = append(view.Peers, peer.addr())
+	}
+	tmpl, err := template.New("bitcoin").Parse(bitcoinconf)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, view); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.conf(), buf.Bytes(), 0644)
+}
+
+func (b *Backend) start() error {
+	if err := exec.Command("bitcoind", "-conf="+b.conf()).Start(); err != nil {
+		return err
+	}
+	return b.rpc.waitReady(30 * time.Second)
+}
+
+func stopBackends() error {
+	failed := []string{}
+	for _, b := range backends {
+		if err := b.rpc.Stop(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", b, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot stop bitcoind, %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// backendFor is the backend an lnd node is assigned to, nodes are spread
+// over the backends in order unless moved with :backend assign
+func backendFor(n int, name string) *Backend {
+	assignedMu.Lock()
+	defer assignedMu.Unlock()
+	i, ok := assigned[name]
+	if !ok {
+		i = (n - 1) % len(backends)
+		assigned[name] = i
+	}
+	return backends[i]
+}
+
+// waitSynced waits for every backend to reach the first backend's tip
+func waitSynced(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		tip, err := btc.GetBlockCount()
+		if err != nil {
+			return err
+		}
+		behind := []string{}
+		for _, b := range backends[1:] {
+			if h, err := b.rpc.GetBlockCount(); err != nil || h < tip {
+				behind = append(behind, b.String())
+			}
+		}
+		if len(behind) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not synced to height %d", strings.Join(behind, ", "), tip)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// partitionBackends cuts the connections between backends in different
+// groups, backends not in any group join the first one
+func partitionBackends(groups [][]int) error {
+	group := make(map[int]int)
+	for g, members := range groups {
+		for _, i := range members {
+			if i < 0 || i >= len(backends) {
+				return fmt.Errorf("no backend %d", i)
+			}
+			if _, ok := group[i]; ok {
+				return fmt.Errorf("backend %d is in more than one group", i)
+			}
+			group[i] = g
+		}
+	}
+	for i := range backends {
+		if _, ok := group[i]; !ok {
+			group[i] = 0
+			groups[0] = append(groups[0], i)
+		}
+	}
+
+	for i, b := range backends {
+		for _, peer := range backends[i+1:] {
+			if group[i] == group[peer.N] {
+				continue
+			}
+			b.rpc.call(nil, "addnode", peer.addr(), "remove")
+			b.rpc.call(nil, "disconnectnode", peer.addr())
+		}
+	}
+	for _, members := range groups {
+		sort.Ints(members)
+	}
+	partitionMu.Lock()
+	partition = groups
+	partitionMu.Unlock()
+	return nil
+}
+
+// healBackends connects every pair again, the chains reconcile on their own
+func healBackends() {
+	for i, b := range backends {
+		for _, peer := range backends[i+1:] {
+			b.rpc.call(nil, "addnode", peer.addr(), "add")
+			b.rpc.call(nil, "addnode", peer.addr(), "onetry")
+		}
+	}
+	partitionMu.Lock()
+	partition = nil
+	partitionMu.Unlock()
+}
+
+// assignBackend points a node's lnd.conf at another backend and restarts it
+func assignBackend(a *alias, b *Backend) error {
+	view := nodeView(a.index(), *a.Name)
+	view.Backend = b
+	if err := writeLndConf(view); err != nil {
+		return err
+	}
+	assignedMu.Lock()
+	assigned[*a.Name] = b.N
+	assignedMu.Unlock()
+	if err := stopLnd(a); err != nil {
+		return err
+	}
+	return startLnd(a)
+}
+
+func backendStatus() string {
+	var s strings.Builder
+	for _, b := range backends {
+		nodes := []string{}
+		assignedMu.Lock()
+		for name, i := range assigned {
+			if i == b.N {
+				nodes = append(nodes, name)
+			}
+		}
+		assignedMu.Unlock()
+		sort.Strings(nodes)
+
+		height, err := b.rpc.GetBlockCount()
+		if err != nil {
+			fmt.Fprintf(&s, "%d %s: %s\n", b.N, b, err.Error())
+			continue
+		}
+		hash, _ := b.rpc.GetBlockHash(height)
+		var peers int
+		b.rpc.call(&peers, "getconnectioncount")
+		fmt.Fprintf(&s, "%d %s: height %d %s, %d peers, lnd: %s\n", b.N, b, height, shortHash(hash), peers, strings.Join(nodes, " "))
+	}
+	partitionMu.Lock()
+	parts := partition
+	partitionMu.Unlock()
+	if parts != nil {
+		groups := []string{}
+		for _, members := range parts {
+			ids := []string{}
+			for _, i := range members {
+				ids = append(ids, strconv.Itoa(i))
+			}
+			groups = append(groups, strings.Join(ids, ","))
+		}
+		fmt.Fprintf(&s, "partitioned: %s\n", strings.Join(groups, " | "))
+	}
+	return s.String()
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 16 {
+		return hash[len(hash)-16:]
+	}
+	return hash
+}
+
+func parseBackend(s string) (*Backend, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= len(backends) {
+		return nil, fmt.Errorf("no backend %s, there are %d", s, len(backends))
+	}
+	return backends[i], nil
+}
+
+// backendCommand takes :backend [status|mine <n> [blocks]|assign <node> <n>|
+// partition <group> <group>...|heal], groups are comma separated backends
+func backendCommand(args []string) string {
+	if scenarios == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 || args[0] == "status" {
+		return backendStatus()
+	}
+
+	switch args[0] {
+	case "mine":
+		if len(args) < 2 {
+			return "usage: backend mine <backend> [blocks=1]"
+		}
+		b, err := parseBackend(args[1])
+		if err != nil {
+			return err.Error()
+		}
+		n := 1
+		if len(args) > 2 {
+			if n, err = strconv.Atoi(args[2]); err != nil || n < 1 {
+				return fmt.Sprintf("invalid block count %s", args[2])
+			}
+		}
+		addr, err := btc.GetNewAddress()
+		if err != nil {
+			return err.Error()
+		}
+		if _, err := b.rpc.GenerateToAddress(n, addr); err != nil {
+			return err.Error()
+		}
+		timeline.add("backend", "mined %d blocks on %s", n, b)
+	case "assign":
+		if len(args) != 3 {
+			return "usage: backend assign <node> <backend>"
+		}
+		a, ok := scenarios.aliases[args[1]]
+		if !ok {
+			return fmt.Sprintf("unknown node %s", args[1])
+		}
+		b, err := parseBackend(args[2])
+		if err != nil {
+			return err.Error()
+		}
+		if err := assignBackend(a, b); err != nil {
+			return err.Error()
+		}
+		timeline.add("backend", "%s now uses %s", *a.Name, b)
+	case "partition":
+		if len(backends) < 2 {
+			return "only one backend is running, set Bitcoin Backends when launching"
+		}
+		if len(args) < 2 {
+			return "usage: backend partition <backends> [backends]..., e.g. partition 0,1 2"
+		}
+		groups := [][]int{}
+		for _, arg := range args[1:] {
+			members := []int{}
+			for _, id := range strings.Split(arg, ",") {
+				i, err := strconv.Atoi(id)
+				if err != nil {
+					return fmt.Sprintf("invalid backend %s", id)
+				}
+				members = append(members, i)
+			}
+			groups = append(groups, members)
+		}
+		if len(groups) == 1 {
+			// a single group is cut off from the rest
+			groups = append([][]int{{}}, groups[0])
+		}
+		if err := partitionBackends(groups); err != nil {
+			return err.Error()
+		}
+		timeline.add("backend", "partitioned %s", strings.Join(args[1:], " | "))
+	case "heal":
+		healBackends()
+		timeline.add("backend", "rejoined all backends")
+	default:
+		return fmt.Sprintf("unknown backend command %s", args[0])
+	}
+	return backendStatus()
+}
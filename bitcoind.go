@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// btcview fills in bitcoinconf, the options bitcoind accepts depend on its
+// version
+type btcview struct {
+	Datadir  string
+	RPCUser  string
+	RPCPass  string
+	RPCPort  int
+	P2PPort  int
+	ZMQBlock int
+	ZMQTx    int
+	Peers    []string
+	Version  int
+}
+
+func (v *btcview) Sections() bool {
+	return v.Version >= CORE_NETWORK_SECTIONS
+}
+
+// FallbackFee lets the wallet send before there are enough blocks with
+// transactions to estimate fees, it is required from 0.19
+func (v *btcview) FallbackFee() bool {
+	return v.Version >= CORE_FALLBACK_FEE
+}
+
+// Bitcoin Core versions in the same form as getnetworkinfo, 0.17.1 is 170100
+// and 25.0.0 is 250000
+const (
+	CORE_NETWORK_SECTIONS = 170000
+	CORE_FALLBACK_FEE     = 190000
+	CORE_DESCRIPTORS      = 210000
+	CORE_GENERATE_BLOCK   = 210000
+	CORE_FEE_RATE         = 210000
+	CORE_DEFAULT_MODERN   = 250000
+)
+
+const BITCOIN_WALLET = "lndev"
+
+var bitcoindVersion int
+
+var versionPattern = regexp.MustCompile(`v(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// detectBitcoind reads the version from bitcoind -version, if it can't be
+// parsed a modern version is assumed
+func detectBitcoind() int {
+	out, err := exec.Command("bitcoind", "-version").Output()
+	if err != nil {
+		return CORE_DEFAULT_MODERN
+	}
+	v := parseCoreVersion(strings.SplitN(string(out), "\n", 2)[0])
+	if v == 0 {
+		return CORE_DEFAULT_MODERN
+	}
+	return v
+}
+
+func parseCoreVersion(s string) int {
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	patch, _ := strconv.Atoi(m[3])
+	if major == 0 {
+		// 0.17.1 style before the leading zero was dropped in 22.0
+		return minor*10000 + patch*100
+	}
+	return major*10000 + minor*100 + patch
+}
+
+func formatCoreVersion(v int) string {
+	if v < 220000 {
+		return fmt.Sprintf("0.%d.%d", v/10000, v/100%100)
+	}
+	return fmt.Sprintf("%d.%d.%d", v/10000, v/100%100, v%100)
+}
+
+// requireCore errors when the running bitcoind is too old for a feature
+func requireCore(v int, feature string) error {
+	if bitcoindVersion != 0 && bitcoindVersion < v {
+		return fmt.Errorf("%s needs Bitcoin Core %s or later, found %s", feature, formatCoreVersion(v), formatCoreVersion(bitcoindVersion))
+	}
+	return nil
+}
+
+// setupWallet loads the lndev wallet or creates it, as a descriptor wallet
+// where supported, since recent versions don't create a default wallet. All
+// wallet calls go to it from then on
+func setupWallet() error {
+	var loaded []string
+	if err := btc.call(&loaded, "listwallets"); err != nil {
+		return err
+	}
+	for _, w := range loaded {
+		if w == BITCOIN_WALLET {
+			btc.wallet = BITCOIN_WALLET
+			return nil
+		}
+	}
+
+	err := btc.call(nil, "loadwallet", BITCOIN_WALLET)
+	if err != nil {
+		if bitcoindVersion >= CORE_DESCRIPTORS {
+			err = btc.call(nil, "createwallet", map[string]interface{}{
+				"wallet_name": BITCOIN_WALLET,
+				"descriptors": true,
+			})
+		} else {
+			err = btc.call(nil, "createwallet", BITCOIN_WALLET)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	btc.wallet = BITCOIN_WALLET
+	return nil
+}
+
+// checkBitcoind compares the running version with the one the config was
+// written for
+func checkBitcoind() {
+	info := struct {
+		Version    int    `json:"version"`
+		Subversion string `json:"subversion"`
+	}{}
+	if err := btc.call(&info, "getnetworkinfo"); err != nil {
+		logger.logerr("bitcoind version check failed", err.Error())
+		return
+	}
+	logger.log(fmt.Sprintf("bitcoind %s %s", formatCoreVersion(info.Version), info.Subversion))
+	if info.Version != bitcoindVersion {
+		logger.logerr("bitcoind version mismatch", fmt.Sprintf("config written for %s", formatCoreVersion(bitcoindVersion)))
+		bitcoindVersion = info.Version
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BREACH_PAYMENTS = 3
+const BREACH_BLOCKS = 10
+
+// Breach snapshots the breacher's datadir, moves the channel state forward
+// with payments to the victim, restores the snapshot and force closes so the
+// revoked commitment is broadcast. With a tower the victim stays offline and
+// the tower has to sweep the funds
+func (s *Scenarios) Breach(breacher, victim, tower *alias, payments int) (string, error) {
+	var report strings.Builder
+	step := func(format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		timeline.add("breach", "%s", msg)
+		report.WriteString(msg + "\n")
+	}
+
+	ch, err := findChannel(breacher, victim)
+	if err != nil {
+		return "", err
+	}
+	amt := ch.LocalBalance / int64(payments+2)
+	if amt > MAX_INVOICE {
+		amt = MAX_INVOICE
+	}
+	if amt < 1 {
+		return "", fmt.Errorf("%s has no balance to pay %s with", *breacher.Name, *victim.Name)
+	}
+	step("breaching channel %s between %s and %s", ch.ChannelPoint, *breacher.Name, *victim.Name)
+
+	if tower != nil {
+		for _, f := range []struct {
+			node    *alias
+			feature string
+		}{{tower, FEATURE_WATCHTOWER}, {victim, FEATURE_WTCLIENT}} {
+			restarted, err := enableFeature(f.node, f.feature)
+			if err != nil {
+				return report.String(), err
+			}
+			if restarted {
+				step("restarted %s with its %s enabled", *f.node.Name, f.feature)
+			}
+		}
+		uri, err := towerURI(tower)
+		if err != nil {
+			return report.String(), err
+		}
+		out, err := victim.Command("wtclient", "add", uri).CombinedOutput()
+		if err != nil {
+			return report.String(), fmt.Errorf("wtclient add: %s", out)
+		}
+		step("%s is watched by tower %s", *victim.Name, *tower.Name)
+	}
+
+	datadir := fmt.Sprintf("%s/.lndev/user%d/data", userdir, breacher.index())
+	backup := datadir + ".breach"
+	os.RemoveAll(backup)
+	if err := stopLnd(breacher); err != nil {
+		return report.String(), err
+	}
+	if err := copyDir(datadir, backup); err != nil {
+		return report.String(), err
+	}
+	if err := startLnd(breacher); err != nil {
+		return report.String(), err
+	}
+	step("saved %s state at %d updates", *breacher.Name, ch.NumUpdates)
+
+	if err := waitActive(breacher, ch.ChanId); err != nil {
+		return report.String(), err
+	}
+	for i := 0; i < payments; i++ {
+		if err := payOver(breacher, victim, ch.ChanId, amt); err != nil {
+			return report.String(), fmt.Errorf("payment %d: %s", i+1, err.Error())
+		}
+	}
+	step("%s paid %s %d times %d sat, state is now revoked", *breacher.Name, *victim.Name, payments, amt)
+	if tower != nil {
+		// give the client time to back up the latest states to the tower
+		time.Sleep(5 * time.Second)
+	}
+
+	// the victim is kept offline so it can't tell the breacher it is behind
+	// before the revoked commitment goes out
+	if err := stopLnd(victim); err != nil {
+		return report.String(), err
+	}
+	if err := stopLnd(breacher); err != nil {
+		return report.String(), err
+	}
+	if err := os.RemoveAll(datadir); err != nil {
+		return report.String(), err
+	}
+	if err := os.Rename(backup, datadir); err != nil {
+		return report.String(), err
+	}
+	if err := startLnd(breacher); err != nil {
+		return report.String(), err
+	}
+	step("restored %s to the old state", *breacher.Name)
+
+	commitment, err := forceClose(breacher, ch.ChannelPoint)
+	if err != nil {
+		return report.String(), err
+	}
+	height, err := btc.GetBlockCount()
+	if err != nil {
+		return report.String(), err
+	}
+	s.launcher.generate(1)
+	step("%s broadcast revoked commitment %s, confirmed at %d", *breacher.Name, commitment, height+1)
+
+	if tower == nil {
+		if err := startLnd(victim); err != nil {
+			return report.String(), err
+		}
+		step("%s is back online", *victim.Name)
+	}
+
+	tx, err := btc.GetRawTransaction(commitment)
+	if err != nil {
+		return report.String(), err
+	}
+	for i := 0; i < BREACH_BLOCKS; i++ {
+		time.Sleep(2 * time.Second)
+		s.launcher.generate(1)
+		if allSpent(tx, height+1) {
+			break
+		}
+	}
+
+	for _, out := range tx.Vout {
+		txid, h, err := spender(commitment, out.N, height+1)
+		switch {
+		case err != nil:
+			step("output %d: %s", out.N, err.Error())
+		case txid == "":
+			step("output %d %.8f BTC to %s: unspent", out.N, out.Value, out.ScriptPubKey.Address)
+		default:
+			step("output %d %.8f BTC to %s: spent by %s at %d", out.N, out.Value, out.ScriptPubKey.Address, txid, h)
+		}
+	}
+
+	if tower != nil {
+		if out, err := tower.Command("tower", "info").CombinedOutput(); err == nil {
+			report.WriteString(string(out))
+		}
+		if err := startLnd(victim); err != nil {
+			return report.String(), err
+		}
+		step("%s is back online", *victim.Name)
+	}
+	report.WriteString(s.closeResult(victim, ch.ChannelPoint))
+	return report.String(), nil
+}
+
+// payOver pays dest with the outgoing channel pinned
+func payOver(src, dest *alias, chanid uint64, amt int64) error {
+	destrpc := grpcClient(dest)
+	srcrpc := grpcClient(src)
+	if destrpc == nil || srcrpc == nil {
+		return fmt.Errorf("cannot connect to %s or %s", *src.Name, *dest.Name)
+	}
+	ctx := context.Background()
+	inv, err := destrpc.AddInvoice(ctx, &lnrpc.Invoice{Value: amt, Memo: "breach scenario"})
+	if err != nil {
+		return err
+	}
+	resp, err := srcrpc.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		PaymentRequest: inv.PaymentRequest,
+		OutgoingChanId: chanid,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.PaymentError != "" {
+		return fmt.Errorf("%s", resp.PaymentError)
+	}
+	return nil
+}
+
+// forceClose broadcasts the node's commitment and returns its txid
+func forceClose(a *alias, point string) (string, error) {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return "", fmt.Errorf("cannot connect to %s", *a.Name)
+	}
+	cp, err := channelPoint(point)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := rpc.CloseChannel(ctx, &lnrpc.CloseChannelRequest{ChannelPoint: cp, Force: true})
+	if err != nil {
+		return "", err
+	}
+	update, err := stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	pending := update.GetClosePending()
+	if pending == nil {
+		return "", fmt.Errorf("unexpected close update %v", update)
+	}
+	hash, err := chainhash.NewHash(pending.Txid)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+func allSpent(tx *rawTx, from int) bool {
+	for _, out := range tx.Vout {
+		txid, _, err := spender(tx.Txid, out.N, from)
+		if err != nil || txid == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// closeResult reports how the node recorded the close of a channel
+func (s *Scenarios) closeResult(a *alias, point string) string {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return fmt.Sprintf("cannot connect to %s\n", *a.Name)
+	}
+	ctx := context.Background()
+	deadline := time.Now().Add(SCENARIO_TIMEOUT)
+	for time.Now().Before(deadline) {
+		closed, err := rpc.ClosedChannels(ctx, &lnrpc.ClosedChannelsRequest{})
+		if err == nil {
+			for _, c := range closed.Channels {
+				if c.ChannelPoint == point {
+					return fmt.Sprintf("%s recorded close %s, settled %d sat, closing tx %s\n", *a.Name, c.CloseType, c.SettledBalance, c.ClosingTxHash)
+				}
+			}
+		}
+		time.Sleep(2 * time.Second)
+		s.launcher.generate(1)
+	}
+	return fmt.Sprintf("%s has not recorded the close yet, check pendingchannels\n", *a.Name)
+}
+
+func towerURI(tower *alias) (string, error) {
+	out, err := tower.Command("tower", "info").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("tower info: %s", out)
+	}
+	info := struct {
+		Pubkey string `json:"pubkey"`
+	}{}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@127.0.0.1:%d", info.Pubkey, tower.Port+3000), nil
+}
+
+// breachCommand parses :breach <breacher> [victim] [payments=3] [tower=<node>]
+func breachCommand(args []string) string {
+	if scenarios == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return "usage: breach <breacher> [victim] [payments=3] [tower=<node>]"
+	}
+	breacher, ok := scenarios.aliases[args[0]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[0])
+	}
+	var victim, tower *alias
+	payments := BREACH_PAYMENTS
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		switch {
+		case len(kv) == 1:
+			if victim, ok = scenarios.aliases[arg]; !ok {
+				return fmt.Sprintf("unknown node %s", arg)
+			}
+		case kv[0] == "payments":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return fmt.Sprintf("invalid payment count %s", kv[1])
+			}
+			payments = n
+		case kv[0] == "tower":
+			if tower, ok = scenarios.aliases[kv[1]]; !ok {
+				return fmt.Sprintf("unknown node %s", kv[1])
+			}
+		default:
+			return fmt.Sprintf("unknown breach setting %s", kv[0])
+		}
+	}
+
+	if victim == nil {
+		ch, err := findChannel(breacher, nil)
+		if err != nil {
+			return err.Error()
+		}
+		if victim = aliasByPubkey(scenarios.aliases, ch.RemotePubkey); victim == nil {
+			return "cannot find the channel peer"
+		}
+	}
+	if victim == breacher || tower == breacher || tower == victim {
+		return "breacher, victim and tower must be different nodes"
+	}
+
+	report, err := scenarios.Breach(breacher, victim, tower, payments)
+	if err != nil {
+		timeline.add("breach", "failed: %s", err.Error())
+		return fmt.Sprintf("%sbreach failed: %s", report, err.Error())
+	}
+	return report
+}
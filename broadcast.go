@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rivo/tview"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BROADCAST_PREFIX runs a command on several nodes at once, @all for every
+// lnd node or @Smith,Jones for a subset
+const BROADCAST_PREFIX = "@"
+
+type broadcastResult struct {
+	name    string
+	out     []byte
+	err     error
+	elapsed time.Duration
+}
+
+func isBroadcast(text string) bool {
+	return strings.HasPrefix(text, BROADCAST_PREFIX)
+}
+
+// broadcastTargets resolves the node list after the prefix
+func (u *MainUI) broadcastTargets(spec string) ([]*alias, error) {
+	targets := []*alias{}
+	if spec == "all" {
+		for _, name := range sortAliasKeys(u.aliases) {
+			if a := u.aliases[name]; a.Port != 0 {
+				targets = append(targets, a)
+			}
+		}
+		return targets, nil
+	}
+	for _, name := range strings.Split(spec, ",") {
+		a, ok := u.aliases[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown node %s", name)
+		}
+		targets = append(targets, a)
+	}
+	return targets, nil
+}
+
+// broadcast runs the command on every target concurrently and groups the
+// output by node, each node's own buffer also gets its part
+func (u *MainUI) broadcast(text string) string {
+	parts := strings.SplitN(strings.TrimPrefix(text, BROADCAST_PREFIX), " ", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		return "usage: @all <command> or @Smith,Jones <command>"
+	}
+	targets, err := u.broadcastTargets(parts[0])
+	if err != nil {
+		return err.Error()
+	}
+	args, err := parseCommandLine(parts[1])
+	if err != nil {
+		return err.Error()
+	}
+
+	results := make([]*broadcastResult, len(targets))
+	var wg sync.WaitGroup
+	for i, a := range targets {
+		wg.Add(1)
+		go (func(i int, a *alias) {
+			defer wg.Done()
+			start := time.Now()
+			out, err := a.Command(args...).CombinedOutput()
+			results[i] = &broadcastResult{*a.Name, out, err, time.Since(start)}
+		})(i, a)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].err == nil && results[j].err != nil
+	})
+
+	var b strings.Builder
+	failed := 0
+	for _, r := range results {
+		status := "ok"
+		if r.err != nil {
+			status = "failed: " + r.err.Error()
+			failed++
+		}
+		fmt.Fprintf(&b, "== %s %s (%s)\n%s\n", r.name, status, r.elapsed.Round(time.Millisecond), strings.TrimRight(string(r.out), "\n"))
+		// the buffers belong to the ui goroutine
+		name := r.name
+		markup := fmt.Sprintf("[#00aaaa]# %s[white]\n%s\n", tview.Escape(text), tview.Escape(string(r.out)))
+		app.QueueUpdateDraw(func() {
+			if n, ok := u.nodes[name]; ok {
+				n.Buff += markup
+			}
+		})
+	}
+	fmt.Fprintf(&b, "== %d ok, %d failed\n", len(results)-failed, failed)
+	return b.String()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// BitcoinRPC talks JSON-RPC to the regtest bitcoind with the credentials
+// written to bitcoin.conf
+type BitcoinRPC struct {
+	url    string
+	user   string
+	pass   string
+	wallet string
+	client *http.Client
+	id     uint64
+}
+
+// the only copy of the rpc credentials, bitcoin.conf and lnd.conf get them
+// from here
+const BITCOIN_RPC_USER = "kek"
+const BITCOIN_RPC_PASS = "kek"
+const BITCOIN_RPC_PORT = 18443
+const BITCOIN_RPC_TIMEOUT = 60 * time.Second
+
+var btc = NewBitcoinRPC(fmt.Sprintf("http://127.0.0.1:%d", BITCOIN_RPC_PORT), BITCOIN_RPC_USER, BITCOIN_RPC_PASS)
+
+func NewBitcoinRPC(url, user, pass string) *BitcoinRPC {
+	return &BitcoinRPC{
+		url:    url,
+		user:   user,
+		pass:   pass,
+		client: &http.Client{Timeout: BITCOIN_RPC_TIMEOUT},
+	}
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// warming up is returned while bitcoind loads its block index
+const RPC_IN_WARMUP = -28
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      uint64      `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// call runs a method with positional params, or named params when given a
+// single map, and decodes the result into result unless it is nil
+func (b *BitcoinRPC) call(result interface{}, method string, params ...interface{}) error {
+	var p interface{} = params
+	if len(params) == 1 {
+		if named, ok := params[0].(map[string]interface{}); ok {
+			p = named
+		}
+	}
+	if params == nil {
+		p = []interface{}{}
+	}
+	body, err := json.Marshal(&rpcRequest{"1.0", atomic.AddUint64(&b.id, 1), method, p})
+	if err != nil {
+		return err
+	}
+	url := b.url
+	if b.wallet != "" {
+		// node calls ignore the path, wallet calls need it once more than
+		// one wallet could be loaded
+		url += "/wallet/" + b.wallet
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.user, b.pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %s", method, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%s: bitcoind rejected the rpc credentials", method)
+	}
+
+	r := &rpcResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return fmt.Errorf("%s: %s %s", method, resp.Status, err.Error())
+	}
+	if r.Error != nil {
+		return fmt.Errorf("%s: %w", method, r.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// waitReady waits for bitcoind to accept rpc calls after it is started
+func (b *BitcoinRPC) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := b.GetBlockCount()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// btcAmount rounds to whole satoshis so amounts don't pick up float noise
+func btcAmount(v float64) float64 {
+	return math.Round(v*1e8) / 1e8
+}
+
+func (b *BitcoinRPC) GetBlockCount() (int, error) {
+	var n int
+	err := b.call(&n, "getblockcount")
+	return n, err
+}
+
+func (b *BitcoinRPC) GetBlockHash(height int) (string, error) {
+	var hash string
+	err := b.call(&hash, "getblockhash", height)
+	return hash, err
+}
+
+type rawBlock struct {
+	Hash   string   `json:"hash"`
+	Height int      `json:"height"`
+	Time   int64    `json:"time"`
+	Size   int      `json:"size"`
+	Tx     []*rawTx `json:"tx"`
+}
+
+// GetBlock returns a block with its transactions decoded
+func (b *BitcoinRPC) GetBlock(hash string) (*rawBlock, error) {
+	block := &rawBlock{}
+	err := b.call(block, "getblock", hash, 2)
+	return block, err
+}
+
+func (b *BitcoinRPC) GetRawTransaction(txid string) (*rawTx, error) {
+	tx := &rawTx{}
+	err := b.call(tx, "getrawtransaction", txid, true)
+	return tx, err
+}
+
+func (b *BitcoinRPC) GetNewAddress() (string, error) {
+	var addr string
+	err := b.call(&addr, "getnewaddress")
+	return addr, err
+}
+
+func (b *BitcoinRPC) GenerateToAddress(n int, address string) ([]string, error) {
+	var hashes []string
+	err := b.call(&hashes, "generatetoaddress", n, address)
+	return hashes, err
+}
+
+// GenerateBlock mines a block with exactly the given txids or raw transactions
+func (b *BitcoinRPC) GenerateBlock(address string, txs []string) (string, error) {
+	if err := requireCore(CORE_GENERATE_BLOCK, "generateblock"); err != nil {
+		return "", err
+	}
+	if txs == nil {
+		txs = []string{}
+	}
+	result := struct {
+		Hash string `json:"hash"`
+	}{}
+	err := b.call(&result, "generateblock", address, txs)
+	return result.Hash, err
+}
+
+func (b *BitcoinRPC) InvalidateBlock(hash string) error {
+	return b.call(nil, "invalidateblock", hash)
+}
+
+func (b *BitcoinRPC) SendToAddress(address string, amount float64) (string, error) {
+	var txid string
+	err := b.call(&txid, "sendtoaddress", address, btcAmount(amount))
+	return txid, err
+}
+
+// SendToAddressFeeRate pays an explicit fee rate in sat/vB
+func (b *BitcoinRPC) SendToAddressFeeRate(address string, amount float64, satvb float64) (string, error) {
+	if err := requireCore(CORE_FEE_RATE, "fee_rate"); err != nil {
+		return "", err
+	}
+	var txid string
+	err := b.call(&txid, "sendtoaddress", map[string]interface{}{
+		"address":  address,
+		"amount":   btcAmount(amount),
+		"fee_rate": math.Round(satvb*1000) / 1000,
+	})
+	return txid, err
+}
+
+func (b *BitcoinRPC) SendMany(amounts map[string]float64) (string, error) {
+	rounded := make(map[string]float64)
+	for addr, amt := range amounts {
+		rounded[addr] = btcAmount(amt)
+	}
+	var txid string
+	err := b.call(&txid, "sendmany", "", rounded)
+	return txid, err
+}
+
+type MempoolInfo struct {
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+}
+
+func (b *BitcoinRPC) GetMempoolInfo() (*MempoolInfo, error) {
+	info := &MempoolInfo{}
+	err := b.call(info, "getmempoolinfo")
+	return info, err
+}
+
+func (b *BitcoinRPC) GetRawMempool() ([]string, error) {
+	var txids []string
+	err := b.call(&txids, "getrawmempool")
+	return txids, err
+}
+
+func (b *BitcoinRPC) GetRawMempoolVerbose() (map[string]*mempoolEntry, error) {
+	mempool := make(map[string]*mempoolEntry)
+	err := b.call(&mempool, "getrawmempool", true)
+	return mempool, err
+}
+
+func (b *BitcoinRPC) GetMempoolEntry(txid string) (*mempoolEntry, error) {
+	entry := &mempoolEntry{}
+	err := b.call(entry, "getmempoolentry", txid)
+	return entry, err
+}
+
+func (b *BitcoinRPC) GetMempoolDescendants(txid string) ([]string, error) {
+	var txids []string
+	err := b.call(&txids, "getmempooldescendants", txid)
+	return txids, err
+}
+
+type FeeEstimate struct {
+	Feerate float64  `json:"feerate"`
+	Errors  []string `json:"errors"`
+}
+
+func (b *BitcoinRPC) EstimateSmartFee(target int) (*FeeEstimate, error) {
+	est := &FeeEstimate{}
+	err := b.call(est, "estimatesmartfee", target)
+	return est, err
+}
+
+type TxInput struct {
+	Txid string `json:"txid"`
+	Vout int    `json:"vout"`
+}
+
+func (b *BitcoinRPC) CreateRawTransaction(inputs []TxInput, outputs map[string]float64) (string, error) {
+	var raw string
+	err := b.call(&raw, "createrawtransaction", inputs, outputs)
+	return raw, err
+}
+
+type SignedTx struct {
+	Hex      string `json:"hex"`
+	Complete bool   `json:"complete"`
+}
+
+func (b *BitcoinRPC) SignRawTransactionWithWallet(raw string) (*SignedTx, error) {
+	signed := &SignedTx{}
+	err := b.call(signed, "signrawtransactionwithwallet", raw)
+	return signed, err
+}
+
+func (b *BitcoinRPC) Stop() error {
+	return b.call(nil, "stop")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChannelOptions are the channel types beyond a plain public channel. lnd
+// only negotiates option-scid-alias for private channels, and zero-conf
+// needs an explicit anchors commitment
+type ChannelOptions struct {
+	ZeroConf  bool
+	ScidAlias bool
+	Private   bool
+}
+
+var channelTypes = []string{"normal", "zero-conf", "scid-alias", "mixed"}
+
+const CHANNEL_MIN = 100000
+const CHANNEL_RANGE = 50000
+
+func NewChannelOptions(chantype string) (*ChannelOptions, error) {
+	if chantype == "mixed" {
+		chantype = channelTypes[rand.Intn(len(channelTypes)-1)]
+	}
+	switch chantype {
+	case "", "normal":
+		return &ChannelOptions{}, nil
+	case "zero-conf":
+		return &ChannelOptions{ZeroConf: true, ScidAlias: true, Private: true}, nil
+	case "scid-alias":
+		return &ChannelOptions{ScidAlias: true, Private: true}, nil
+	}
+	return nil, fmt.Errorf("unknown channel type %s, use %s", chantype, strings.Join(channelTypes, ", "))
+}
+
+// channelFeatures are the lnd protocol options both ends of a channel of the
+// type need, mixed may pick any type
+func channelFeatures(chantype string) []string {
+	switch chantype {
+	case "zero-conf", "mixed":
+		return []string{FEATURE_SCID_ALIAS, FEATURE_ZERO_CONF}
+	case "scid-alias":
+		return []string{FEATURE_SCID_ALIAS}
+	}
+	return nil
+}
+
+func (o *ChannelOptions) String() string {
+	switch {
+	case o.ZeroConf:
+		return "zero-conf"
+	case o.ScidAlias:
+		return "scid-alias"
+	case o.Private:
+		return "private"
+	}
+	return "normal"
+}
+
+// openChannel opens a channel of the given type and returns its channel
+// point. Nodes without the protocol options the type needs are restarted
+// with them first, the receiving node gets a channel acceptor for zero-conf
+// requests
+func openChannel(src, dest *alias, amount int64, opts *ChannelOptions) (string, error) {
+	restarted := make(map[*alias]bool)
+	for _, a := range []*alias{src, dest} {
+		r, err := enableFeature(a, channelFeatures(opts.String())...)
+		if err != nil {
+			return "", err
+		}
+		restarted[a] = r
+	}
+	rpc := grpcClient(src)
+	peer := nodeInfo(dest)
+	if rpc == nil || peer == nil {
+		return "", fmt.Errorf("cannot connect to %s or %s", *src.Name, *dest.Name)
+	}
+	if restarted[dest] {
+		// the acceptor the node had before the restart is gone
+		acceptorsMu.Lock()
+		delete(acceptors, *dest.Name)
+		acceptorsMu.Unlock()
+	}
+	if restarted[src] || restarted[dest] {
+		_, err := rpc.ConnectPeer(context.Background(), &lnrpc.ConnectPeerRequest{
+			Addr: &lnrpc.LightningAddress{
+				Pubkey: peer.IdentityPubkey,
+				Host:   fmt.Sprintf("127.0.0.1:%d", dest.Port+1000)},
+			Perm: false})
+		if err != nil && !strings.Contains(err.Error(), "already connected") {
+			return "", err
+		}
+	}
+	req := &lnrpc.OpenChannelRequest{
+		NodePubkeyString:   peer.GetIdentityPubkey(),
+		LocalFundingAmount: amount,
+		Private:            opts.Private,
+		ZeroConf:           opts.ZeroConf,
+		ScidAlias:          opts.ScidAlias,
+	}
+	if opts.ZeroConf || opts.ScidAlias {
+		req.CommitmentType = lnrpc.CommitmentType_ANCHORS
+	}
+	fresh := false
+	if opts.ZeroConf {
+		var err error
+		if fresh, err = acceptZeroConf(dest); err != nil {
+			return "", err
+		}
+	}
+	point, err := rpc.OpenChannelSync(context.Background(), req)
+	// lnd registers an acceptor some time after the stream is opened, a
+	// zero-conf open racing it is rejected and tried again
+	for i := 0; err != nil && fresh && i < ACCEPTOR_RETRIES; i++ {
+		time.Sleep(time.Second)
+		point, err = rpc.OpenChannelSync(context.Background(), req)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", fundingTxid(point), point.OutputIndex), nil
+}
+
+// channel acceptor streams by node
+var acceptors = make(map[string]lnrpc.Lightning_ChannelAcceptorClient)
+var acceptorsMu sync.Mutex
+
+const ACCEPTOR_RETRIES = 5
+
+// acceptZeroConf runs a channel acceptor on the node, lnd only accepts a
+// zero-conf channel when an acceptor says so. Every other request is
+// accepted as it would be without one. The stream ends when the node stops
+// and the next zero-conf open starts it again. It reports whether the
+// acceptor was just started
+func acceptZeroConf(a *alias) (bool, error) {
+	acceptorsMu.Lock()
+	defer acceptorsMu.Unlock()
+	if acceptors[*a.Name] != nil {
+		return false, nil
+	}
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return false, fmt.Errorf("cannot connect to %s", *a.Name)
+	}
+	stream, err := rpc.ChannelAcceptor(context.Background(), grpc.WaitForReady(true))
+	if err != nil {
+		return false, err
+	}
+	acceptors[*a.Name] = stream
+
+	go (func() {
+		defer (func() {
+			acceptorsMu.Lock()
+			if acceptors[*a.Name] == stream {
+				delete(acceptors, *a.Name)
+			}
+			acceptorsMu.Unlock()
+		})()
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			resp := &lnrpc.ChannelAcceptResponse{
+				Accept:        true,
+				PendingChanId: req.PendingChanId,
+			}
+			if req.WantsZeroConf {
+				resp.ZeroConf = true
+				resp.MinAcceptDepth = 0
+			}
+			if err := stream.Send(resp); err != nil {
+				return
+			}
+		}
+	})()
+	return true, nil
+}
+
+// waitChannel waits for a channel to be active and returns it
+func waitChannel(a *alias, point string) (*lnrpc.Channel, error) {
+	deadline := time.Now().Add(SCENARIO_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if rpc := grpcClient(a); rpc != nil {
+			chans, err := rpc.ListChannels(context.Background(), &lnrpc.ListChannelsRequest{ActiveOnly: true})
+			if err == nil {
+				for _, c := range chans.Channels {
+					if c.ChannelPoint == point {
+						return c, nil
+					}
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("channel %s of %s did not become active", point, *a.Name)
+}
+
+func scidString(scid uint64) string {
+	return fmt.Sprintf("%dx%dx%d", scid>>40, (scid>>16)&0xffffff, scid&0xffff)
+}
+
+// openCommand parses :open <src> <dest> [amount=<sat>] [type=normal]
+func openCommand(args []string) string {
+	if scenarios == nil {
+		return "network not launched"
+	}
+	if len(args) < 2 {
+		return fmt.Sprintf("usage: open <src> <dest> [amount=<sat>] [type=%s]", strings.Join(channelTypes[:len(channelTypes)-1], "|"))
+	}
+	src, ok := scenarios.aliases[args[0]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[0])
+	}
+	dest, ok := scenarios.aliases[args[1]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[1])
+	}
+	amount := int64(rand.Intn(CHANNEL_RANGE) + CHANNEL_MIN)
+	opts := &ChannelOptions{}
+	for _, arg := range args[2:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Sprintf("invalid setting %s, expected key=value", arg)
+		}
+		switch kv[0] {
+		case "amount":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || n < 1 {
+				return fmt.Sprintf("invalid amount %s", kv[1])
+			}
+			amount = n
+		case "type":
+			o, err := NewChannelOptions(kv[1])
+			if err != nil {
+				return err.Error()
+			}
+			opts = o
+		default:
+			return fmt.Sprintf("unknown open setting %s", kv[0])
+		}
+	}
+
+	point, err := openChannel(src, dest, amount, opts)
+	if err != nil {
+		return err.Error()
+	}
+	timeline.add("channel", "%s opened %s channel %s to %s for %d sat", *src.Name, opts, point, *dest.Name, amount)
+	if !opts.ZeroConf {
+		return fmt.Sprintf("opened %s channel %s, mine blocks to confirm it", opts, point)
+	}
+
+	c, err := waitChannel(src, point)
+	if err != nil {
+		return err.Error()
+	}
+	aliases := []string{}
+	for _, scid := range c.AliasScids {
+		aliases = append(aliases, scidString(scid))
+	}
+	return fmt.Sprintf("opened zero-conf channel %s, usable now with alias scids %s, peer alias %s", point, strings.Join(aliases, " "), scidString(c.PeerScidAlias))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Chaos takes nodes or single peer connections offline at random while the
+// network is in use and brings them back after a random down time
+type Chaos struct {
+	agent
+	aliases  map[string]*alias
+	mode     string
+	every    time.Duration
+	mindown  time.Duration
+	maxdown  time.Duration
+	dist     string
+	down     map[string]bool
+	outages  int
+	restored int
+}
+
+const CHAOS_EVERY = time.Minute
+const CHAOS_MIN_DOWN = 10 * time.Second
+const CHAOS_MAX_DOWN = time.Minute
+
+var chaos *Chaos
+
+func NewChaos(aliases map[string]*alias) *Chaos {
+	return &Chaos{
+		aliases: aliases,
+		mode:    "node",
+		every:   CHAOS_EVERY,
+		mindown: CHAOS_MIN_DOWN,
+		maxdown: CHAOS_MAX_DOWN,
+		dist:    "uniform",
+		down:    make(map[string]bool),
+	}
+}
+
+func (c *Chaos) Start() {
+	if !c.start(func(stop chan struct{}) {
+		repeat(stop, c.nextOutage, c.outage)
+	}) {
+		return
+	}
+	c.showStatus()
+	c.mu.Lock()
+	timeline.add("chaos", "started, %s outages every ~%s, down %s-%s %s", c.mode, c.every, c.mindown, c.maxdown, c.dist)
+	c.mu.Unlock()
+}
+
+func (c *Chaos) Stop() {
+	c.halt()
+	c.showStatus()
+	timeline.add("chaos", "stopped, nodes still down are restored when their down time ends")
+}
+
+// nextOutage is exponentially distributed so outages arrive as a poisson
+// process averaging one per interval
+func (c *Chaos) nextOutage() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(rand.ExpFloat64() * float64(c.every))
+}
+
+func (c *Chaos) downtime() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dist == "exp" {
+		d := c.mindown + time.Duration(rand.ExpFloat64()*float64(c.maxdown-c.mindown)/2)
+		if d > c.maxdown {
+			d = c.maxdown
+		}
+		return d
+	}
+	return c.mindown + time.Duration(rand.Int63n(int64(c.maxdown-c.mindown)+1))
+}
+
+// pick chooses a random node that is not already down and marks it as down
+func (c *Chaos) pick() *alias {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	up := make([]*alias, 0, len(c.aliases))
+	for _, a := range c.aliases {
+		if !c.down[*a.Name] {
+			up = append(up, a)
+		}
+	}
+	if len(up) == 0 {
+		return nil
+	}
+	a := up[rand.Intn(len(up))]
+	c.down[*a.Name] = true
+	return a
+}
+
+func (c *Chaos) release(a *alias) {
+	c.mu.Lock()
+	delete(c.down, *a.Name)
+	c.mu.Unlock()
+}
+
+func (c *Chaos) isDown(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down[name]
+}
+
+func (c *Chaos) outage() {
+	a := c.pick()
+	if a == nil {
+		return
+	}
+	d := c.downtime()
+	c.mu.Lock()
+	mode := c.mode
+	c.outages++
+	c.mu.Unlock()
+
+	go (func() {
+		defer (func() {
+			c.release(a)
+			c.showStatus()
+		})()
+		if mode == "peer" {
+			c.peerOutage(a, d)
+		} else {
+			c.nodeOutage(a, d)
+		}
+	})()
+	c.showStatus()
+}
+
+func (c *Chaos) nodeOutage(a *alias, d time.Duration) {
+	timeline.add("chaos", "stopping %s for %s", *a.Name, d)
+	if err := stopLnd(a); err != nil {
+		timeline.add("chaos", "stop %s failed: %s", *a.Name, err.Error())
+		return
+	}
+	timeline.add("chaos", "%s is down", *a.Name)
+	time.Sleep(d)
+
+	if err := startLnd(a); err != nil {
+		timeline.add("chaos", "restart %s failed: %s", *a.Name, err.Error())
+		return
+	}
+	c.mu.Lock()
+	c.restored++
+	c.mu.Unlock()
+	timeline.add("chaos", "%s is back up after %s", *a.Name, d)
+}
+
+func (c *Chaos) peerOutage(a *alias, d time.Duration) {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return
+	}
+	ctx := context.Background()
+	peers, err := rpc.ListPeers(ctx, &lnrpc.ListPeersRequest{})
+	if err != nil || len(peers.Peers) == 0 {
+		timeline.add("chaos", "%s has no peers to disconnect", *a.Name)
+		return
+	}
+	peer := peers.Peers[rand.Intn(len(peers.Peers))]
+	remote := aliasByPubkey(c.aliases, peer.PubKey)
+	if remote == nil {
+		return
+	}
+
+	timeline.add("chaos", "disconnecting %s from %s for %s", *a.Name, *remote.Name, d)
+	_, err = rpc.DisconnectPeer(ctx, &lnrpc.DisconnectPeerRequest{PubKey: peer.PubKey})
+	if err != nil {
+		timeline.add("chaos", "disconnect %s from %s failed: %s", *a.Name, *remote.Name, err.Error())
+		return
+	}
+	time.Sleep(d)
+
+	_, err = rpc.ConnectPeer(ctx, &lnrpc.ConnectPeerRequest{
+		Addr: &lnrpc.LightningAddress{
+			Pubkey: peer.PubKey,
+			Host:   fmt.Sprintf("127.0.0.1:%d", remote.Port+1000)},
+		Perm: false})
+	if err != nil && !strings.Contains(err.Error(), "already connected") {
+		timeline.add("chaos", "reconnect %s to %s failed: %s", *a.Name, *remote.Name, err.Error())
+		return
+	}
+	c.mu.Lock()
+	c.restored++
+	c.mu.Unlock()
+	timeline.add("chaos", "%s reconnected to %s after %s", *a.Name, *remote.Name, d)
+}
+
+func (c *Chaos) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running && len(c.down) == 0 {
+		return "chaos: off"
+	}
+	names := make([]string, 0, len(c.down))
+	for name := range c.down {
+		names = append(names, name)
+	}
+	state := "on"
+	if !c.running {
+		state = "stopping"
+	}
+	return fmt.Sprintf("chaos: %s %d/%d restored, down: %s", state, c.restored, c.outages, strings.Join(names, ","))
+}
+
+func (c *Chaos) showStatus() {
+	showAgentStatus("chaos", c)
+}
+
+// aliasByPubkey looks in the cached pubkeys first and only asks the nodes
+// whose pubkey is not known yet
+func aliasByPubkey(aliases map[string]*alias, pubkey string) *alias {
+	unknown := []*alias{}
+	for _, a := range aliases {
+		cached, ok := cachedPubkey(a)
+		if !ok {
+			unknown = append(unknown, a)
+		} else if cached == pubkey {
+			return a
+		}
+	}
+	for _, a := range unknown {
+		if nodePubkey(a) == pubkey {
+			return a
+		}
+	}
+	return nil
+}
+
+// chaosCommand takes key=value settings, e.g.
+// :chaos start mode=peer every=30s down=5s-20s dist=exp
+func chaosCommand(args []string) string {
+	if chaos == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return chaos.String()
+	}
+
+	if err := agentCommand("chaos", chaos, args); err != nil {
+		return err.Error()
+	}
+	c := chaos
+	c.mu.Lock()
+	settings := fmt.Sprintf("mode=%s every=%s down=%s-%s dist=%s", c.mode, c.every, c.mindown, c.maxdown, c.dist)
+	c.mu.Unlock()
+	return fmt.Sprintf("%s\n%s", c.String(), settings)
+}
+
+func (c *Chaos) set(key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch key {
+	case "mode":
+		if value != "node" && value != "peer" {
+			return fmt.Errorf("mode must be node or peer")
+		}
+		c.mode = value
+	case "every":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid interval %s", value)
+		}
+		c.every = d
+	case "down":
+		bounds := strings.SplitN(value, "-", 2)
+		min, err := time.ParseDuration(bounds[0])
+		if err != nil {
+			return fmt.Errorf("invalid down time %s", value)
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = time.ParseDuration(bounds[1])
+			if err != nil || max < min {
+				return fmt.Errorf("invalid down time %s", value)
+			}
+		}
+		c.mindown = min
+		c.maxdown = max
+	case "dist":
+		if value != "uniform" && value != "exp" {
+			return fmt.Errorf("dist must be uniform or exp")
+		}
+		c.dist = value
+	default:
+		return fmt.Errorf("unknown chaos setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Churn keeps the channel graph changing by opening channels between random
+// nodes and closing existing ones, mining as needed so the opens confirm and
+// force closes mature
+type Churn struct {
+	agent
+	aliases  map[string]*alias
+	launcher *Launcher
+	every    time.Duration
+	close    float64
+	force    float64
+	opened   int
+	closed   int
+}
+
+const CHURN_EVERY = 30 * time.Second
+const CHURN_CLOSE = 0.4
+const CHURN_FORCE = 0.3
+
+var churn *Churn
+
+func NewChurn(aliases map[string]*alias, launcher *Launcher) *Churn {
+	return &Churn{
+		aliases:  aliases,
+		launcher: launcher,
+		every:    CHURN_EVERY,
+		close:    CHURN_CLOSE,
+		force:    CHURN_FORCE,
+	}
+}
+
+func (c *Churn) Start() {
+	if !c.start(func(stop chan struct{}) {
+		repeat(stop, c.wait, c.tick)
+	}) {
+		return
+	}
+	c.showStatus()
+	timeline.add("churn", "started")
+}
+
+func (c *Churn) Stop() {
+	c.halt()
+	c.showStatus()
+	timeline.add("churn", "stopped")
+}
+
+func (c *Churn) wait() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.every
+}
+
+func (c *Churn) tick() {
+	c.mu.Lock()
+	closeRatio := c.close
+	forceRatio := c.force
+	c.mu.Unlock()
+
+	if rand.Float64() < closeRatio {
+		c.closeRandom(rand.Float64() < forceRatio)
+	} else {
+		c.openRandom()
+	}
+	c.confirm()
+	c.showStatus()
+}
+
+// openRandom opens a channel between two nodes that don't already share one
+func (c *Churn) openRandom() {
+	keys := sortAliasKeys(c.aliases)
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	ctx := context.Background()
+	for _, s := range keys {
+		src := c.aliases[s]
+		rpc := grpcClient(src)
+		if rpc == nil {
+			continue
+		}
+		chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		have := make(map[string]bool)
+		for _, ch := range chans.Channels {
+			have[ch.RemotePubkey] = true
+		}
+		for _, ch := range pending.PendingOpenChannels {
+			have[ch.Channel.RemoteNodePub] = true
+		}
+
+		for _, d := range keys {
+			dest := c.aliases[d]
+			if d == s {
+				continue
+			}
+			info := nodeInfo(dest)
+			if info == nil || have[info.IdentityPubkey] {
+				continue
+			}
+
+			_, err := rpc.ConnectPeer(ctx, &lnrpc.ConnectPeerRequest{
+				Addr: &lnrpc.LightningAddress{
+					Pubkey: info.IdentityPubkey,
+					Host:   fmt.Sprintf("127.0.0.1:%d", dest.Port+1000)},
+				Perm: false})
+			if err != nil && !strings.Contains(err.Error(), "already connected") {
+				timeline.add("churn", "connect %s -> %s failed: %s", s, d, err.Error())
+				continue
+			}
+
+			amt := int64(rand.Intn(50000) + 100000)
+			point, err := rpc.OpenChannelSync(ctx, &lnrpc.OpenChannelRequest{
+				NodePubkeyString:   info.IdentityPubkey,
+				LocalFundingAmount: amt,
+			})
+			if err != nil {
+				timeline.add("churn", "open %s -> %s failed: %s", s, d, err.Error())
+				return
+			}
+			addConnection(s, d)
+			c.mu.Lock()
+			c.opened++
+			c.mu.Unlock()
+			timeline.add("churn", "opened %s -> %s %d sat, funding %s", s, d, amt, fundingTxid(point))
+			return
+		}
+	}
+	timeline.add("churn", "no unconnected pair of nodes left to open a channel")
+}
+
+// closeRandom closes a random active channel, either cooperatively or by
+// broadcasting the local commitment
+func (c *Churn) closeRandom(force bool) {
+	keys := sortAliasKeys(c.aliases)
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	ctx := context.Background()
+	for _, s := range keys {
+		rpc := grpcClient(c.aliases[s])
+		if rpc == nil {
+			continue
+		}
+		chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true})
+		if err != nil || len(chans.Channels) == 0 {
+			continue
+		}
+		ch := chans.Channels[rand.Intn(len(chans.Channels))]
+		point, err := channelPoint(ch.ChannelPoint)
+		if err != nil {
+			continue
+		}
+
+		kind := "cooperative"
+		if force {
+			kind = "force"
+		}
+		closectx, cancel := context.WithCancel(ctx)
+		stream, err := rpc.CloseChannel(closectx, &lnrpc.CloseChannelRequest{
+			ChannelPoint: point,
+			Force:        force,
+		})
+		if err == nil {
+			// the first update is close_pending once the closing tx is broadcast
+			_, err = stream.Recv()
+		}
+		cancel()
+		if err != nil {
+			timeline.add("churn", "%s close of %s by %s failed: %s", kind, ch.ChannelPoint, s, err.Error())
+			return
+		}
+		c.mu.Lock()
+		c.closed++
+		c.mu.Unlock()
+		timeline.add("churn", "%s close of %s by %s", kind, ch.ChannelPoint, s)
+		return
+	}
+	timeline.add("churn", "no active channels left to close")
+}
+
+// confirm mines enough blocks to confirm pending opens and closes and to
+// mature the time locked outputs of force closes
+func (c *Churn) confirm() {
+	ctx := context.Background()
+	blocks := 0
+	for _, a := range c.aliases {
+		rpc := grpcClient(a)
+		if rpc == nil {
+			continue
+		}
+		pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		if len(pending.PendingOpenChannels) > 0 || len(pending.WaitingCloseChannels) > 0 {
+			blocks = max(blocks, 6)
+		}
+		for _, ch := range pending.PendingForceClosingChannels {
+			blocks = max(blocks, int(ch.BlocksTilMaturity)+1)
+			for _, htlc := range ch.PendingHtlcs {
+				blocks = max(blocks, int(htlc.BlocksTilMaturity)+1)
+			}
+		}
+	}
+	if blocks > 0 {
+		c.launcher.generate(blocks)
+		timeline.add("churn", "mined %d blocks", blocks)
+	}
+}
+
+// nodeInfo returns the node's getinfo, cached from the launch if available
+func nodeInfo(a *alias) *lnrpc.GetInfoResponse {
+	if info, ok := peerInfo(*a.Name); ok {
+		return info
+	}
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return nil
+	}
+	info, err := rpc.GetInfo(context.Background(), &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+func (c *Churn) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return "churn: off"
+	}
+	return fmt.Sprintf("churn: %d opened %d closed", c.opened, c.closed)
+}
+
+func (c *Churn) showStatus() {
+	showAgentStatus("churn", c)
+}
+
+// churnCommand takes key=value settings like chaosCommand, e.g.
+// :churn start every=20s close=0.5 force=0.25
+func churnCommand(args []string) string {
+	if churn == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return churn.String()
+	}
+
+	if err := agentCommand("churn", churn, args); err != nil {
+		return err.Error()
+	}
+	c := churn
+	c.mu.Lock()
+	settings := fmt.Sprintf("every=%s close=%.2f force=%.2f", c.every, c.close, c.force)
+	c.mu.Unlock()
+	return fmt.Sprintf("%s\n%s", c.String(), settings)
+}
+
+func (c *Churn) set(key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch key {
+	case "every":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid interval %s", value)
+		}
+		c.every = d
+	case "close", "force":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("%s must be a ratio between 0 and 1", key)
+		}
+		if key == "close" {
+			c.close = f
+		} else {
+			c.force = f
+		}
+	default:
+		return fmt.Errorf("unknown churn setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// internal commands are entered at the cli prompt prefixed with ':' and are
+// handled by lnd-dev itself instead of being passed to lncli or bitcoin-cli
+const COMMAND_PREFIX = ":"
+
+type command struct {
+	usage string
+	run   func(args []string) string
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help": {
+			usage: "help",
+			run:   commandHelp,
+		},
+		"activity": {
+			usage: "activity [status|pause|resume|stop|rate <duration>|amount <min> <max>|add <n>|record <file>|off]",
+			run:   activityCommand,
+		},
+		"fees": {
+			usage: "fees [start|stop|set|status|mine|spike [rate=100] [count=50]] [min=1] [max=50] [dist=uniform|exp] [txs=5] [every=5s] [block=30s] [size=5000]",
+			run:   feesCommand,
+		},
+		"fund": {
+			usage: "fund <node> <btc> [utxos=1] [type=nested|native|taproot|mixed]",
+			run:   fundCommand,
+		},
+		"miner": {
+			usage: "miner [start|stop|set|status] [mode=fixed|random|mempool] [every=10s]",
+			run:   minerCommand,
+		},
+		"rebalance": {
+			usage: "rebalance [start|stop|set|status] [threshold=80] [every=15s]",
+			run:   rebalanceCommand,
+		},
+		"reorg": {
+			usage: "reorg <blocks> [mine=<blocks>] [drop=funding|txid,...] [replace=txid,...]",
+			run:   reorgCommand,
+		},
+		"replay": {
+			usage: "replay [start <file> [speed=1]|stop]",
+			run:   replayCommand,
+		},
+		"events": {
+			usage: "events [n] [kind]",
+			run:   eventsCommand,
+		},
+		"backend": {
+			usage: "backend [status|mine <backend> [blocks]|assign <node> <backend>|partition <backends> [backends]...|heal]",
+			run:   backendCommand,
+		},
+		"breach": {
+			usage: "breach <breacher> [victim] [payments=3] [tower=<node>]",
+			run:   breachCommand,
+		},
+		"chaos": {
+			usage: "chaos [start|stop|set|status] [mode=node|peer] [every=1m] [down=10s-1m] [dist=uniform|exp]",
+			run:   chaosCommand,
+		},
+		"churn": {
+			usage: "churn [start|stop|set|status] [every=30s] [close=0.4] [force=0.3]",
+			run:   churnCommand,
+		},
+		"htlc": {
+			usage: "htlc <sender> <receiver> [mode=offline|hold] [amount=10000] [cltv=40] [blocks=500]",
+			run:   htlcCommand,
+		},
+		"open": {
+			usage: "open <src> <dest> [amount=<sat>] [type=normal|zero-conf|scid-alias]",
+			run:   openCommand,
+		},
+		"tx": {
+			usage: "tx <txid>",
+			run:   txCommand,
+		},
+	}
+}
+
+func isCommand(text string) bool {
+	return strings.HasPrefix(text, COMMAND_PREFIX)
+}
+
+func runCommand(text string) string {
+	args, err := parseCommandLine(strings.TrimPrefix(text, COMMAND_PREFIX))
+	if err != nil {
+		return err.Error()
+	}
+	if len(args) == 0 {
+		return commandHelp(args)
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		return fmt.Sprintf("unknown command %s, try %shelp", args[0], COMMAND_PREFIX)
+	}
+	return c.run(args[1:])
+}
+
+func commandHelp(args []string) string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s%s\n", COMMAND_PREFIX, commands[name].usage)
+	}
+	return b.String()
+}
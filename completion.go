@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rivo/tview"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Completer expands the last word of the cli for the current node. Command
+// and flag names are parsed once from the binaries' help, node values are
+// looked up each time so they follow the network
+type Completer struct {
+	aliases  map[string]*alias
+	commands map[string][]string
+	flags    map[string][]string
+	payreqs  []string
+	mu       sync.Mutex
+}
+
+var completer *Completer
+
+const COMPLETE_PAYREQS = 20
+const COMPLETE_SHOW = 40
+
+// COMPLETE_TIMEOUT bounds each lookup a tab makes, a node that is down
+// gives no candidates instead of holding up the completion
+const COMPLETE_TIMEOUT = 2 * time.Second
+
+var payreqPattern = regexp.MustCompile(`lnbcrt[0-9a-z]+`)
+
+// usage words of internal commands, placeholders in <> are left out
+var usagePlaceholder = regexp.MustCompile(`<[^>]*>`)
+var usageWord = regexp.MustCompile(`[a-z][a-z-]*=?`)
+
+// positional arguments of lncli subcommands that take a node or a channel
+var completeArgs = map[string]string{
+	"connect":          "connect",
+	"disconnect":       "pubkey",
+	"openchannel":      "pubkey",
+	"batchopenchannel": "pubkey",
+	"queryroutes":      "pubkey",
+	"getnodeinfo":      "pubkey",
+	"closechannel":     "chanpoint",
+	"abandonchannel":   "chanpoint",
+	"payinvoice":       "payreq",
+	"sendpayment":      "payreq",
+	"decodepayreq":     "payreq",
+}
+
+func NewCompleter(aliases map[string]*alias) *Completer {
+	return &Completer{
+		aliases:  aliases,
+		commands: make(map[string][]string),
+		flags:    make(map[string][]string),
+	}
+}
+
+// harvest keeps the payment requests seen in command output, newest first
+func (c *Completer) harvest(out string) {
+	found := payreqPattern.FindAllString(out, -1)
+	if len(found) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range found {
+		for i, q := range c.payreqs {
+			if q == p {
+				c.payreqs = append(c.payreqs[:i], c.payreqs[i+1:]...)
+				break
+			}
+		}
+		c.payreqs = append([]string{p}, c.payreqs...)
+	}
+	if len(c.payreqs) > COMPLETE_PAYREQS {
+		c.payreqs = c.payreqs[:COMPLETE_PAYREQS]
+	}
+}
+
+// complete returns the candidates for the last word of text on the node
+func (c *Completer) complete(node string, text string) []string {
+	words := strings.Fields(text)
+	word := ""
+	if !strings.HasSuffix(text, " ") && len(words) > 0 {
+		word = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	var cands []string
+	switch {
+	case strings.HasPrefix(word, VARIABLE_PREFIX):
+		cands = c.variables()
+	case len(words) == 0 && isCommand(word):
+		for name := range commands {
+			cands = append(cands, COMMAND_PREFIX+name)
+		}
+	case len(words) == 0 && isBroadcast(word):
+		// complete the node after the last comma of @Smith,Jo
+		spec := strings.TrimPrefix(word, BROADCAST_PREFIX)
+		done := spec[:strings.LastIndex(spec, ",")+1]
+		for _, name := range append([]string{"all"}, sortAliasKeys(c.aliases)...) {
+			cands = append(cands, BROADCAST_PREFIX+done+name)
+		}
+	case len(words) > 0 && isCommand(words[0]):
+		cands = c.commandArgs(strings.TrimPrefix(words[0], COMMAND_PREFIX))
+	default:
+		a, ok := c.aliases[node]
+		if len(words) > 0 && isBroadcast(words[0]) {
+			// a broadcast completes like a command on its first node
+			a, ok = c.broadcastNode(words[0])
+			words = words[1:]
+		}
+		if !ok {
+			return nil
+		}
+		cands = c.cliArgs(a, words, word)
+	}
+	return matching(cands, word)
+}
+
+// variables are the $ values a command can use, see interpolate
+func (c *Completer) variables() []string {
+	cands := []string{VARIABLE_PREFIX + "last", VARIABLE_PREFIX + "last.json."}
+	for _, name := range sortAliasKeys(c.aliases) {
+		if c.aliases[name].Port == 0 {
+			continue
+		}
+		for _, field := range variableFields {
+			cands = append(cands, VARIABLE_PREFIX+name+"."+field)
+		}
+	}
+	return cands
+}
+
+func (c *Completer) broadcastNode(spec string) (*alias, bool) {
+	spec = strings.TrimPrefix(spec, BROADCAST_PREFIX)
+	for _, name := range sortAliasKeys(c.aliases) {
+		a := c.aliases[name]
+		if spec == "all" && a.Port != 0 || strings.Split(spec, ",")[0] == name {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// commandArgs are the words of an internal command's usage and node names
+func (c *Completer) commandArgs(name string) []string {
+	cmd, ok := commands[name]
+	if !ok {
+		return nil
+	}
+	usage := usagePlaceholder.ReplaceAllString(cmd.usage, "")
+	cands := sortAliasKeys(c.aliases)
+	for _, w := range usageWord.FindAllString(usage, -1) {
+		if w != name {
+			cands = append(cands, w)
+		}
+	}
+	return cands
+}
+
+// cliArgs completes an lncli or bitcoin-cli command line, the subcommand
+// first, then flags, then values for the flag or argument being typed
+func (c *Completer) cliArgs(a *alias, words []string, word string) []string {
+	binary := strings.Split(*a.Path, " ")[0]
+	sub := ""
+	for _, w := range words {
+		if !strings.HasPrefix(w, "-") {
+			sub = w
+			break
+		}
+	}
+	if sub == "" {
+		return c.subcommands(a, binary)
+	}
+	if a.Port == 0 {
+		// bitcoin-cli has no per-command flags
+		return nil
+	}
+	if k := strings.SplitN(word, "=", 2); strings.HasPrefix(word, "--") && len(k) == 2 {
+		vals := c.values(a, flagKind(k[0]))
+		for i, v := range vals {
+			vals[i] = k[0] + "=" + v
+		}
+		return vals
+	}
+	if strings.HasPrefix(word, "-") {
+		return c.subflags(a, sub)
+	}
+
+	kind := completeArgs[sub]
+	if prev := words[len(words)-1]; strings.HasPrefix(prev, "--") && !strings.Contains(prev, "=") {
+		kind = flagKind(prev)
+	}
+	return c.values(a, kind)
+}
+
+// flagKind tells what a flag takes from its name
+func flagKind(flag string) string {
+	flag = strings.TrimLeft(flag, "-")
+	switch {
+	case strings.Contains(flag, "chan_point") || flag == "funding_txid":
+		return "chanpoint"
+	case strings.Contains(flag, "pub_key") || strings.Contains(flag, "pubkey") || flag == "node_key" || flag == "dest" || flag == "peer":
+		return "pubkey"
+	case flag == "pay_req" || flag == "invoice":
+		return "payreq"
+	case flag == "chan_id" || flag == "outgoing_chan_id":
+		return "chanid"
+	}
+	return "unknown"
+}
+
+// values are the node names, pubkeys, channels and payment requests that fit
+// the argument
+func (c *Completer) values(a *alias, kind string) []string {
+	var cands []string
+	switch kind {
+	case "pubkey", "connect":
+		for _, name := range sortAliasKeys(c.aliases) {
+			peer := c.aliases[name]
+			if peer.Port == 0 || peer == a {
+				continue
+			}
+			pubkey := nodePubkey(peer)
+			if pubkey == "" {
+				continue
+			}
+			cands = append(cands, name)
+			if kind == "connect" {
+				cands = append(cands, fmt.Sprintf("%s@127.0.0.1:%d", pubkey, peer.Port+1000))
+			} else {
+				cands = append(cands, pubkey)
+			}
+		}
+		cands = append(cands, c.peers(a)...)
+	case "chanpoint", "chanid":
+		cands = c.channels(a, kind)
+	case "payreq":
+		c.mu.Lock()
+		cands = append(cands, c.payreqs...)
+		c.mu.Unlock()
+	case "unknown":
+		return nil
+	}
+	return cands
+}
+
+// expand turns a node name into its pubkey, or pubkey@host for connect, when
+// the argument takes one
+func (c *Completer) expand(node string, text string) (string, bool) {
+	words := strings.Fields(text)
+	if len(words) < 2 || strings.HasSuffix(text, " ") || isCommand(words[0]) {
+		return "", false
+	}
+	peer, ok := c.aliases[words[len(words)-1]]
+	if !ok || peer.Port == 0 {
+		return "", false
+	}
+	a, ok := c.aliases[node]
+	if isBroadcast(words[0]) {
+		a, ok = c.broadcastNode(words[0])
+		words = words[1:]
+	}
+	if !ok || a.Port == 0 || len(words) < 2 {
+		return "", false
+	}
+	kind := completeArgs[words[0]]
+	if prev := words[len(words)-2]; strings.HasPrefix(prev, "--") {
+		kind = flagKind(prev)
+	}
+	pubkey := nodePubkey(peer)
+	if pubkey == "" {
+		return "", false
+	}
+	switch kind {
+	case "pubkey":
+		return pubkey, true
+	case "connect":
+		return fmt.Sprintf("%s@127.0.0.1:%d", pubkey, peer.Port+1000), true
+	}
+	return "", false
+}
+
+func (c *Completer) peers(a *alias) []string {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), COMPLETE_TIMEOUT)
+	defer cancel()
+	peers, err := rpc.ListPeers(ctx, &lnrpc.ListPeersRequest{})
+	if err != nil {
+		return nil
+	}
+	cands := []string{}
+	for _, p := range peers.Peers {
+		cands = append(cands, p.PubKey)
+	}
+	return cands
+}
+
+// channels lists the node's open and pending channels as channel points, or
+// as short channel ids for chanid
+func (c *Completer) channels(a *alias, kind string) []string {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), COMPLETE_TIMEOUT)
+	defer cancel()
+	cands := []string{}
+	if chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{}); err == nil {
+		for _, ch := range chans.Channels {
+			if kind == "chanid" {
+				cands = append(cands, fmt.Sprintf("%d", ch.ChanId))
+			} else {
+				cands = append(cands, ch.ChannelPoint)
+			}
+		}
+	}
+	if kind == "chanid" {
+		return cands
+	}
+	if pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{}); err == nil {
+		for _, p := range pending.PendingOpenChannels {
+			cands = append(cands, p.Channel.ChannelPoint)
+		}
+		for _, w := range pending.WaitingCloseChannels {
+			cands = append(cands, w.Channel.ChannelPoint)
+		}
+	}
+	return cands
+}
+
+// subcommands of lncli are parsed from --help, bitcoin-cli lists its rpcs
+// with help on the backend
+func (c *Completer) subcommands(a *alias, binary string) []string {
+	c.mu.Lock()
+	cached, ok := c.commands[binary]
+	c.mu.Unlock()
+	if ok {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), COMPLETE_TIMEOUT)
+	defer cancel()
+	var cands []string
+	if a.Port == 0 {
+		args := strings.Split(*a.Path, " ")
+		out, _ := exec.CommandContext(ctx, args[0], append(args[1:], "help")...).CombinedOutput()
+		for _, line := range strings.Split(string(out), "\n") {
+			if f := strings.Fields(line); len(f) > 0 && !strings.HasPrefix(line, "==") {
+				cands = append(cands, f[0])
+			}
+		}
+	} else {
+		out, _ := exec.CommandContext(ctx, binary, "--help").CombinedOutput()
+		cands = helpSection(string(out), "COMMANDS:", false)
+	}
+	if len(cands) == 0 {
+		// the backend may not be up yet, try again on the next tab
+		return nil
+	}
+	c.mu.Lock()
+	c.commands[binary] = cands
+	c.mu.Unlock()
+	return cands
+}
+
+func (c *Completer) subflags(a *alias, sub string) []string {
+	c.mu.Lock()
+	cached, ok := c.flags[sub]
+	c.mu.Unlock()
+	if ok {
+		return cached
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), COMPLETE_TIMEOUT)
+	defer cancel()
+	binary := strings.Split(*a.Path, " ")[0]
+	out, _ := exec.CommandContext(ctx, binary, sub, "--help").CombinedOutput()
+	cands := helpSection(string(out), "OPTIONS:", true)
+	if len(cands) == 0 {
+		// like subcommands, a failed --help is tried again on the next tab
+		return nil
+	}
+	c.mu.Lock()
+	c.flags[sub] = cands
+	c.mu.Unlock()
+	return cands
+}
+
+// helpSection reads the names listed under a heading of urfave/cli help,
+// the first name of each flag or command, command categories end with ':'
+// and are skipped
+func helpSection(help string, heading string, flags bool) []string {
+	names := []string{}
+	in := false
+	for _, line := range strings.Split(help, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == heading {
+			in = true
+			continue
+		}
+		if !in || trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			// the next heading
+			break
+		}
+		name := strings.TrimSuffix(strings.Fields(trimmed)[0], ",")
+		if flags && !strings.HasPrefix(name, "--") || strings.HasSuffix(name, ":") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// matching keeps the candidates that start with the word, sorted and once
+func matching(cands []string, word string) []string {
+	seen := make(map[string]bool)
+	found := []string{}
+	for _, c := range cands {
+		if strings.HasPrefix(c, word) && !seen[c] {
+			seen[c] = true
+			found = append(found, c)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// commonPrefix is the longest prefix the candidates share
+func commonPrefix(cands []string) string {
+	if len(cands) == 0 {
+		return ""
+	}
+	prefix := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// complete is bound to tab on the cli, a single candidate replaces the last
+// word, several extend it to what they share and are listed in the output.
+// The lookups run off the event loop and the result is dropped if the text
+// changed meanwhile
+func (u *MainUI) complete() {
+	if completer == nil {
+		return
+	}
+	text := u.cli.GetText()
+	node := u.currentnode
+	go (func() {
+		line, listing := completeLine(node, text)
+		app.QueueUpdateDraw(func() {
+			if u.cli.GetText() != text || u.currentnode != node {
+				return
+			}
+			if line != text {
+				u.cli.SetText(line)
+			}
+			if listing != "" {
+				fmt.Fprintf(u.cliresult, "[gray]%s[white]\n", tview.Escape(listing))
+				u.cliresult.ScrollToEnd()
+			}
+		})
+	})()
+}
+
+// completeLine returns the completed text and the candidates to list, if
+// there are several that share nothing more
+func completeLine(node string, text string) (string, string) {
+	head := text[:strings.LastIndex(text, " ")+1]
+	if pubkey, ok := completer.expand(node, text); ok {
+		return head + pubkey + " ", ""
+	}
+	cands := completer.complete(node, text)
+	switch len(cands) {
+	case 0:
+		return text, ""
+	case 1:
+		if pubkey, ok := completer.expand(node, head+cands[0]); ok {
+			return head + pubkey + " ", ""
+		}
+		return head + cands[0] + " ", ""
+	}
+	if prefix := commonPrefix(cands); len(head+prefix) > len(text) {
+		return head + prefix, ""
+	}
+	more := ""
+	if len(cands) > COMPLETE_SHOW {
+		more = fmt.Sprintf(" ... %d more", len(cands)-COMPLETE_SHOW)
+		cands = cands[:COMPLETE_SHOW]
+	}
+	return text, strings.Join(cands, "  ") + more
+}
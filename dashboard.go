@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rivo/tview"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dashboard shows the selected node's balances, channels, htlcs, peers and
+// recent invoices and payments beside the command output, refreshed while it
+// is showing
+type Dashboard struct {
+	*tview.Flex
+	view    *tview.TextView
+	aliases map[string]*alias
+	visible bool
+	stop    chan bool
+	mu      sync.Mutex
+}
+
+var dashboard *Dashboard
+
+const DASHBOARD_POLL = 2 * time.Second
+const DASHBOARD_RECENT = 5
+const BALANCE_BAR = 20
+
+func NewDashboard(aliases map[string]*alias, output tview.Primitive) *Dashboard {
+	d := &Dashboard{
+		Flex:    tview.NewFlex(),
+		view:    tview.NewTextView().SetDynamicColors(true),
+		aliases: aliases,
+	}
+	d.view.SetBorder(true).SetTitle("Dashboard (Ctrl+d to close)")
+	d.AddItem(output, 0, 1, false).AddItem(d.view, 0, 1, false)
+	return d
+}
+
+// Focus stays on the cli, the dashboard only follows the selected node
+func (d *Dashboard) Focus(delegate func(p tview.Primitive)) {
+	delegate(ui.cli)
+}
+
+func (d *Dashboard) Show() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.visible {
+		return
+	}
+	d.visible = true
+	d.stop = make(chan bool)
+	stop := d.stop
+	go (func() {
+		for {
+			d.refresh()
+			select {
+			case <-stop:
+				return
+			case <-time.After(DASHBOARD_POLL):
+			}
+		}
+	})()
+}
+
+func (d *Dashboard) Hide() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.visible {
+		return
+	}
+	d.visible = false
+	close(d.stop)
+}
+
+func (d *Dashboard) refresh() {
+	text := "select an lnd node with Ctrl+n"
+	if a, ok := d.aliases[ui.selectedNode()]; ok {
+		text = d.render(a)
+	}
+	app.QueueUpdateDraw(func() {
+		row, col := d.view.GetScrollOffset()
+		d.view.SetText(text)
+		d.view.ScrollTo(row, col)
+	})
+}
+
+func (d *Dashboard) render(a *alias) string {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return fmt.Sprintf("[red]cannot connect to %s[white]", *a.Name)
+	}
+	ctx := context.Background()
+	var s strings.Builder
+	section := func(title string) {
+		fmt.Fprintf(&s, "\n[yellow]%s[white]\n", title)
+	}
+
+	info, err := rpc.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return fmt.Sprintf("[red]%s: %s[white]", *a.Name, tview.Escape(err.Error()))
+	}
+	fmt.Fprintf(&s, "[yellow]%s[white] %s\nheight %d, synced to chain %t, synced to graph %t\n",
+		*a.Name, info.IdentityPubkey, info.BlockHeight, info.SyncedToChain, info.SyncedToGraph)
+
+	section("On-chain")
+	if bal, err := rpc.WalletBalance(ctx, &lnrpc.WalletBalanceRequest{}); err == nil {
+		fmt.Fprintf(&s, "confirmed %d sat, unconfirmed %d sat, locked %d sat\n", bal.ConfirmedBalance, bal.UnconfirmedBalance, bal.LockedBalance)
+	}
+
+	chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err == nil {
+		section(fmt.Sprintf("Channels (%d)", len(chans.Channels)))
+		for _, c := range chans.Channels {
+			state := "active"
+			if !c.Active {
+				state = "[red]inactive[white]"
+			}
+			if c.Private {
+				state += " private"
+			}
+			fmt.Fprintf(&s, "%-12s %s %8d / %-8d %s %s\n", d.peerName(c.RemotePubkey), balanceBar(c.LocalBalance, c.RemoteBalance), c.LocalBalance, c.RemoteBalance, scidString(c.ChanId), state)
+		}
+
+		section("In-flight HTLCs")
+		n := 0
+		for _, c := range chans.Channels {
+			for _, h := range c.PendingHtlcs {
+				dir := "out to"
+				if h.Incoming {
+					dir = "in from"
+				}
+				fmt.Fprintf(&s, "%s %-12s %8d sat, hash %x, expires at %d\n", dir, d.peerName(c.RemotePubkey), h.Amount, h.HashLock[:4], h.ExpirationHeight)
+				n++
+			}
+		}
+		if n == 0 {
+			s.WriteString("none\n")
+		}
+	}
+
+	if pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{}); err == nil {
+		section("Pending channels")
+		for _, p := range pending.PendingOpenChannels {
+			fmt.Fprintf(&s, "opening with %-12s %8d sat %s\n", d.peerName(p.Channel.RemoteNodePub), p.Channel.Capacity, p.Channel.ChannelPoint)
+		}
+		for _, w := range pending.WaitingCloseChannels {
+			fmt.Fprintf(&s, "closing with %-12s %8d sat in limbo, waiting for %s\n", d.peerName(w.Channel.RemoteNodePub), w.LimboBalance, w.ClosingTxid)
+		}
+		for _, f := range pending.PendingForceClosingChannels {
+			fmt.Fprintf(&s, "force closed with %-12s %8d sat in limbo, %d blocks to maturity, %d htlcs\n", d.peerName(f.Channel.RemoteNodePub), f.LimboBalance, f.BlocksTilMaturity, len(f.PendingHtlcs))
+		}
+		if len(pending.PendingOpenChannels)+len(pending.WaitingCloseChannels)+len(pending.PendingForceClosingChannels) == 0 {
+			s.WriteString("none\n")
+		}
+	}
+
+	if peers, err := rpc.ListPeers(ctx, &lnrpc.ListPeersRequest{}); err == nil {
+		section(fmt.Sprintf("Peers (%d)", len(peers.Peers)))
+		for _, p := range peers.Peers {
+			dir := "outbound"
+			if p.Inbound {
+				dir = "inbound"
+			}
+			fmt.Fprintf(&s, "%-12s %s %s, ping %dms\n", d.peerName(p.PubKey), p.Address, dir, p.PingTime/1000)
+		}
+	}
+
+	if invoices, err := rpc.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{NumMaxInvoices: DASHBOARD_RECENT, Reversed: true}); err == nil {
+		section("Recent invoices")
+		for i := len(invoices.Invoices) - 1; i >= 0; i-- {
+			inv := invoices.Invoices[i]
+			fmt.Fprintf(&s, "%s %8d sat %-9s %s\n", time.Unix(inv.CreationDate, 0).Format("15:04:05"), inv.Value, inv.State, tview.Escape(inv.Memo))
+		}
+	}
+
+	if payments, err := rpc.ListPayments(ctx, &lnrpc.ListPaymentsRequest{MaxPayments: DASHBOARD_RECENT, Reversed: true, IncludeIncomplete: true}); err == nil {
+		section("Recent payments")
+		for i := len(payments.Payments) - 1; i >= 0; i-- {
+			p := payments.Payments[i]
+			fmt.Fprintf(&s, "%s %8d sat fee %d %-9s %s\n", time.Unix(0, p.CreationTimeNs).Format("15:04:05"), p.ValueSat, p.FeeSat, p.Status, p.PaymentHash[:16])
+		}
+	}
+	return s.String()
+}
+
+func (d *Dashboard) peerName(pubkey string) string {
+	if a := aliasByPubkey(d.aliases, pubkey); a != nil {
+		return *a.Name
+	}
+	return pubkey[:12]
+}
+
+// balanceBar splits a fixed width bar between the local and remote balance
+func balanceBar(local, remote int64) string {
+	total := local + remote
+	n := 0
+	if total > 0 {
+		n = int((local*BALANCE_BAR + total/2) / total)
+	}
+	return fmt.Sprintf("[green]%s[blue]%s[white]", strings.Repeat("█", n), strings.Repeat("█", BALANCE_BAR-n))
+}
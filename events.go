@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeline records what background tasks did to the network so it can be
+// lined up against the behavior seen in the nodes
+type Timeline struct {
+	events []*Event
+	mu     sync.Mutex
+}
+
+type Event struct {
+	Time time.Time
+	Kind string
+	Msg  string
+}
+
+var timeline = &Timeline{}
+
+const MAX_EVENTS = 1000
+
+func (t *Timeline) add(kind string, format string, a ...interface{}) {
+	t.mu.Lock()
+	t.events = append(t.events, &Event{time.Now(), kind, fmt.Sprintf(format, a...)})
+	if len(t.events) > MAX_EVENTS {
+		t.events = t.events[len(t.events)-MAX_EVENTS:]
+	}
+	t.mu.Unlock()
+}
+
+// last returns up to n of the most recent events, optionally of one kind
+func (t *Timeline) last(n int, kind string) []*Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	found := make([]*Event, 0, min(n, len(t.events)))
+	for i := len(t.events) - 1; i >= 0 && len(found) < n; i-- {
+		if kind == "" || t.events[i].Kind == kind {
+			found = append([]*Event{t.events[i]}, found...)
+		}
+	}
+	return found
+}
+
+func eventsCommand(args []string) string {
+	n := 20
+	kind := ""
+	for _, arg := range args {
+		if i, err := strconv.Atoi(arg); err == nil {
+			if i < 1 {
+				return "usage: events [n] [kind], n must be at least 1"
+			}
+			n = i
+		} else {
+			kind = arg
+		}
+	}
+
+	var b strings.Builder
+	for _, e := range timeline.last(n, kind) {
+		fmt.Fprintf(&b, "%s %-8s %s\n", e.Time.Format("15:04:05.000"), e.Kind, e.Msg)
+	}
+	if b.Len() == 0 {
+		return "no events"
+	}
+	return b.String()
+}
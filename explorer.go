@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rivo/tview"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Explorer lists the mempool and recent blocks of the regtest chain and
+// labels each transaction by what it does to the nodes' channels
+type Explorer struct {
+	*tview.Flex
+	aliases    map[string]*alias
+	list       *tview.List
+	detail     *tview.TextView
+	entries    []*explorerEntry
+	expanded   map[string]bool
+	index      *chanIndex
+	seen       string
+	mempool    map[string]*rawTx
+	visible    bool
+	stop       chan bool
+	mu         sync.Mutex
+	refreshing sync.Mutex
+}
+
+type explorerEntry struct {
+	block  *rawBlock
+	tx     *rawTx
+	height int
+}
+
+var explorer *Explorer
+
+const EXPLORER_BLOCKS = 10
+const EXPLORER_POLL = 3 * time.Second
+
+func NewExplorer(aliases map[string]*alias) *Explorer {
+	e := &Explorer{
+		Flex:     tview.NewFlex().SetDirection(tview.FlexColumn),
+		aliases:  aliases,
+		list:     tview.NewList().ShowSecondaryText(false),
+		detail:   tview.NewTextView(),
+		expanded: make(map[string]bool),
+		index:    &chanIndex{},
+		mempool:  make(map[string]*rawTx),
+	}
+	e.list.SetBorder(true).SetTitle("Chain (Enter expands a block, Right for details, Ctrl+e to close)")
+	e.detail.SetBorder(true).SetTitle("Details")
+	e.AddItem(e.list, 0, 2, true)
+	e.AddItem(e.detail, 0, 3, false)
+
+	e.list.SetChangedFunc(func(i int, main string, secondary string, shortcut rune) {
+		e.showDetail(i)
+	})
+	e.list.SetSelectedFunc(func(i int, main string, secondary string, shortcut rune) {
+		e.mu.Lock()
+		if i < len(e.entries) && e.entries[i].block != nil {
+			hash := e.entries[i].block.Hash
+			e.expanded[hash] = !e.expanded[hash]
+		}
+		e.mu.Unlock()
+		go e.refresh()
+	})
+	e.list.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		if key.Key() == tcell.KeyRight {
+			app.SetFocus(e.detail)
+			return nil
+		}
+		return key
+	})
+	e.detail.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		if key.Key() == tcell.KeyLeft {
+			app.SetFocus(e.list)
+			return nil
+		}
+		return key
+	})
+	return e
+}
+
+// Show starts polling the chain while the explorer is visible
+func (e *Explorer) Show() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.visible {
+		return
+	}
+	e.visible = true
+	e.stop = make(chan bool)
+	stop := e.stop
+	go (func() {
+		for {
+			e.refresh()
+			select {
+			case <-stop:
+				return
+			case <-time.After(EXPLORER_POLL):
+			}
+		}
+	})()
+}
+
+func (e *Explorer) Hide() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.visible {
+		return
+	}
+	e.visible = false
+	close(e.stop)
+}
+
+// refresh reloads the mempool and the last blocks, keeping the selection.
+// Nothing is fetched beyond the tip and the mempool while neither changed,
+// and mempool transactions already seen are not fetched again
+func (e *Explorer) refresh() {
+	e.refreshing.Lock()
+	defer e.refreshing.Unlock()
+
+	mempool, err := btc.GetRawMempool()
+	if err != nil {
+		app.QueueUpdateDraw(func() {
+			e.detail.SetText(err.Error())
+		})
+		return
+	}
+	sort.Strings(mempool)
+	height, err := btc.GetBlockCount()
+	if err != nil {
+		return
+	}
+	tip, err := btc.GetBlockHash(height)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	expanded := make(map[string]bool)
+	open := []string{}
+	for k, v := range e.expanded {
+		if v {
+			expanded[k] = v
+			open = append(open, k)
+		}
+	}
+	sort.Strings(open)
+	seen := fmt.Sprintf("%s %s %s", tip, strings.Join(mempool, ","), strings.Join(open, ","))
+	if seen == e.seen {
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+
+	index := newChanIndex(e.aliases)
+	entries := []*explorerEntry{}
+	txs := make(map[string]*rawTx)
+	for _, txid := range mempool {
+		tx, ok := e.mempool[txid]
+		if !ok {
+			if tx, err = btc.GetRawTransaction(txid); err != nil {
+				continue
+			}
+		}
+		txs[txid] = tx
+		entries = append(entries, &explorerEntry{tx: tx, height: -1})
+	}
+	e.mempool = txs
+
+	for h := height; h > height-EXPLORER_BLOCKS && h >= 0; h-- {
+		hash, err := btc.GetBlockHash(h)
+		if err != nil {
+			return
+		}
+		block, err := btc.GetBlock(hash)
+		if err != nil {
+			return
+		}
+		entries = append(entries, &explorerEntry{block: block, height: h})
+		if expanded[hash] {
+			for _, tx := range block.Tx {
+				entries = append(entries, &explorerEntry{tx: tx, height: h})
+			}
+		}
+	}
+	items := []string{}
+	for _, entry := range entries {
+		items = append(items, entryText(entry, index, expanded))
+	}
+
+	e.mu.Lock()
+	e.seen = seen
+	e.mu.Unlock()
+	app.QueueUpdateDraw(func() {
+		e.mu.Lock()
+		e.entries = entries
+		e.index = index
+		e.mu.Unlock()
+
+		cur := e.list.GetCurrentItem()
+		e.list.Clear()
+		for _, item := range items {
+			e.list.AddItem(item, "", 0, nil)
+		}
+		if cur >= len(entries) {
+			cur = len(entries) - 1
+		}
+		if cur >= 0 {
+			e.list.SetCurrentItem(cur)
+		}
+		e.showDetail(cur)
+	})
+}
+
+func entryText(entry *explorerEntry, index *chanIndex, expanded map[string]bool) string {
+	if entry.block != nil {
+		mark := "+"
+		if expanded[entry.block.Hash] {
+			mark = "-"
+		}
+		return fmt.Sprintf("%s block %d  %d txs", mark, entry.height, len(entry.block.Tx))
+	}
+	where := "mempool"
+	if entry.height >= 0 {
+		where = "  "
+	}
+	return fmt.Sprintf("  %s %s  %s", where, entry.tx.Txid[:16], index.label(entry.tx))
+}
+
+func (e *Explorer) showDetail(i int) {
+	e.mu.Lock()
+	if i < 0 || i >= len(e.entries) {
+		e.mu.Unlock()
+		e.detail.SetText("")
+		return
+	}
+	entry := e.entries[i]
+	index := e.index
+	e.mu.Unlock()
+
+	if entry.block != nil {
+		e.detail.SetText(describeBlock(entry.block, index))
+	} else {
+		e.detail.SetText(describeTx(entry.tx, entry.height, index))
+	}
+	e.detail.ScrollToBeginning()
+}
+
+func describeBlock(b *rawBlock, index *chanIndex) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "block %d\n%s\n", b.Height, b.Hash)
+	fmt.Fprintf(&s, "time %s, %d bytes, %d txs\n\n", time.Unix(b.Time, 0).Format("15:04:05"), b.Size, len(b.Tx))
+	for _, tx := range b.Tx {
+		fmt.Fprintf(&s, "%s  %s\n", tx.Txid, index.label(tx))
+	}
+	return s.String()
+}
+
+// describeTx decodes a transaction with every input and output that belongs
+// to a channel marked
+func describeTx(tx *rawTx, height int, index *chanIndex) string {
+	var s strings.Builder
+	where := "mempool"
+	if height >= 0 {
+		where = fmt.Sprintf("block %d", height)
+	}
+	fmt.Fprintf(&s, "%s\n%s, %d vbytes\n%s\n\n", tx.Txid, where, tx.Vsize, index.label(tx))
+
+	s.WriteString("inputs\n")
+	for _, in := range tx.Vin {
+		if in.Coinbase != "" {
+			s.WriteString("  coinbase\n")
+			continue
+		}
+		outpoint := fmt.Sprintf("%s:%d", in.Txid, in.Vout)
+		fmt.Fprintf(&s, "  %s  %s\n", outpoint, index.outpoint(outpoint))
+	}
+	s.WriteString("\noutputs\n")
+	for _, out := range tx.Vout {
+		outpoint := fmt.Sprintf("%s:%d", tx.Txid, out.N)
+		fmt.Fprintf(&s, "  %d  %.8f BTC  %s %s  %s\n", out.N, out.Value, out.ScriptPubKey.Type, out.ScriptPubKey.Address, index.outpoint(outpoint))
+	}
+	return s.String()
+}
+
+// chanIndex collects the on-chain footprint of every channel the nodes know
+// about, open, pending or closed
+type chanIndex struct {
+	funding     map[string]string // channel point to the pair of nodes
+	closes      map[string]string // closing txid to the kind of close
+	commitments map[string]string // force closed commitment txid to the kind of spend
+	htlcs       map[string]string // htlc outputs still to be swept to what spends them
+	pairs       map[string]string // closing txid to the pair of nodes
+}
+
+func newChanIndex(aliases map[string]*alias) *chanIndex {
+	x := &chanIndex{
+		funding:     make(map[string]string),
+		closes:      make(map[string]string),
+		commitments: make(map[string]string),
+		htlcs:       make(map[string]string),
+		pairs:       make(map[string]string),
+	}
+	ctx := context.Background()
+	for _, a := range aliases {
+		rpc := grpcClient(a)
+		if rpc == nil {
+			continue
+		}
+		if chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{}); err == nil {
+			for _, c := range chans.Channels {
+				x.funding[c.ChannelPoint] = pairName(aliases, a, c.RemotePubkey)
+			}
+		}
+		if pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{}); err == nil {
+			for _, p := range pending.PendingOpenChannels {
+				x.funding[p.Channel.ChannelPoint] = pairName(aliases, a, p.Channel.RemoteNodePub)
+			}
+			for _, w := range pending.WaitingCloseChannels {
+				pair := pairName(aliases, a, w.Channel.RemoteNodePub)
+				x.funding[w.Channel.ChannelPoint] = pair
+				if w.ClosingTxid == "" {
+					continue
+				}
+				x.pairs[w.ClosingTxid] = pair
+				c := w.Commitments
+				if c != nil && (w.ClosingTxid == c.LocalTxid || w.ClosingTxid == c.RemoteTxid || w.ClosingTxid == c.RemotePendingTxid) {
+					x.setClose(w.ClosingTxid, "force close", "sweep")
+				} else {
+					x.setClose(w.ClosingTxid, "cooperative close", "")
+				}
+			}
+			for _, f := range pending.PendingForceClosingChannels {
+				pair := pairName(aliases, a, f.Channel.RemoteNodePub)
+				x.funding[f.Channel.ChannelPoint] = pair
+				x.pairs[f.ClosingTxid] = pair
+				x.setClose(f.ClosingTxid, "force close", "sweep")
+				for _, h := range f.PendingHtlcs {
+					x.htlcs[h.Outpoint] = htlcSpend(h, pair)
+				}
+			}
+		}
+		if closed, err := rpc.ClosedChannels(ctx, &lnrpc.ClosedChannelsRequest{}); err == nil {
+			for _, c := range closed.Channels {
+				pair := pairName(aliases, a, c.RemotePubkey)
+				x.funding[c.ChannelPoint] = pair
+				x.pairs[c.ClosingTxHash] = pair
+				switch c.CloseType {
+				case lnrpc.ChannelCloseSummary_COOPERATIVE_CLOSE:
+					x.setClose(c.ClosingTxHash, "cooperative close", "")
+				case lnrpc.ChannelCloseSummary_LOCAL_FORCE_CLOSE, lnrpc.ChannelCloseSummary_REMOTE_FORCE_CLOSE:
+					x.setClose(c.ClosingTxHash, "force close", "sweep")
+				case lnrpc.ChannelCloseSummary_BREACH_CLOSE:
+					x.setClose(c.ClosingTxHash, "revoked force close", "justice")
+				}
+			}
+		}
+	}
+	return x
+}
+
+// setClose records how a channel was closed, a breach seen by the victim
+// wins over the force close the breacher recorded
+func (x *chanIndex) setClose(txid, kind, spend string) {
+	if x.commitments[txid] == "justice" {
+		return
+	}
+	x.closes[txid] = kind
+	if spend != "" {
+		x.commitments[txid] = spend
+	}
+}
+
+// label names what a transaction does, funding outputs are checked last so a
+// close that pays into a new channel is still shown as a close
+func (x *chanIndex) label(tx *rawTx) string {
+	for _, in := range tx.Vin {
+		if in.Coinbase != "" {
+			return "coinbase"
+		}
+		outpoint := fmt.Sprintf("%s:%d", in.Txid, in.Vout)
+		if pair, ok := x.funding[outpoint]; ok {
+			if kind, ok := x.closes[tx.Txid]; ok {
+				return fmt.Sprintf("%s %s", kind, pair)
+			}
+			return fmt.Sprintf("close %s", pair)
+		}
+		if spend, ok := x.htlcs[outpoint]; ok {
+			return spend
+		}
+		if spend, ok := x.commitments[in.Txid]; ok {
+			return fmt.Sprintf("%s %s", spend, x.pairs[in.Txid])
+		}
+	}
+	for _, out := range tx.Vout {
+		if pair, ok := x.funding[fmt.Sprintf("%s:%d", tx.Txid, out.N)]; ok {
+			return fmt.Sprintf("channel funding %s", pair)
+		}
+	}
+	return "wallet"
+}
+
+// outpoint names a single input or output
+func (x *chanIndex) outpoint(outpoint string) string {
+	if pair, ok := x.funding[outpoint]; ok {
+		return fmt.Sprintf("channel %s", pair)
+	}
+	if spend, ok := x.htlcs[outpoint]; ok {
+		return fmt.Sprintf("htlc output, %s", spend)
+	}
+	txid := strings.SplitN(outpoint, ":", 2)[0]
+	if kind, ok := x.closes[txid]; ok {
+		return fmt.Sprintf("%s output %s", kind, x.pairs[txid])
+	}
+	return ""
+}
+
+// htlcSpend names the transaction that resolves a pending htlc output, on
+// the commitment it is an htlc timeout or success transaction, later stages
+// sweep their outputs
+func htlcSpend(h *lnrpc.PendingHTLC, pair string) string {
+	switch {
+	case h.Stage > 1:
+		return fmt.Sprintf("htlc sweep %s", pair)
+	case h.Incoming:
+		return fmt.Sprintf("htlc success %s", pair)
+	}
+	return fmt.Sprintf("htlc timeout %s", pair)
+}
+
+// pairName names a channel by both ends in alphabetical order so each side
+// reports the same name
+func pairName(aliases map[string]*alias, a *alias, remote string) string {
+	other := remote
+	if len(other) > 8 {
+		other = other[:8]
+	}
+	if r := aliasByPubkey(aliases, remote); r != nil {
+		other = *r.Name
+	}
+	names := []string{*a.Name, other}
+	sort.Strings(names)
+	return names[0] + "-" + names[1]
+}
+
+// txCommand parses :tx <txid> and prints the labeled transaction
+func txCommand(args []string) string {
+	if explorer == nil {
+		return "network not launched"
+	}
+	if len(args) != 1 {
+		return "usage: tx <txid>"
+	}
+	tx, err := btc.GetRawTransaction(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	height := -1
+	if tx.Blockhash != "" {
+		if block, err := btc.GetBlock(tx.Blockhash); err == nil {
+			height = block.Height
+		}
+	}
+	return describeTx(tx, height, newChanIndex(explorer.aliases))
+}
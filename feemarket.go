@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FeeMarket fills the mempool with bitcoind wallet transactions paying a
+// spread of fee rates and mines small blocks that only take the best paying
+// ones, so estimatesmartfee has real data and fees can be pushed up on demand
+type FeeMarket struct {
+	agent
+	minrate    float64
+	maxrate    float64
+	dist       string
+	txs        int
+	every      time.Duration
+	blockevery time.Duration
+	blocksize  int
+	sent       int
+	failed     int
+}
+
+const FEE_MIN_RATE = 1.0
+const FEE_MAX_RATE = 50.0
+const FEE_TXS = 5
+const FEE_EVERY = 5 * time.Second
+const FEE_BLOCK_EVERY = 30 * time.Second
+const FEE_BLOCK_VSIZE = 5000
+
+var feemarket *FeeMarket
+
+func NewFeeMarket() *FeeMarket {
+	return &FeeMarket{
+		minrate:    FEE_MIN_RATE,
+		maxrate:    FEE_MAX_RATE,
+		dist:       "uniform",
+		txs:        FEE_TXS,
+		every:      FEE_EVERY,
+		blockevery: FEE_BLOCK_EVERY,
+		blocksize:  FEE_BLOCK_VSIZE,
+	}
+}
+
+func (f *FeeMarket) Start() {
+	if !f.start(func(stop chan struct{}) {
+		repeat(stop, f.sendWait, f.sendRound)
+	}, func(stop chan struct{}) {
+		repeat(stop, f.blockWait, f.blockRound)
+	}) {
+		return
+	}
+	f.showStatus()
+	timeline.add("fees", "started")
+}
+
+func (f *FeeMarket) Stop() {
+	f.halt()
+	f.showStatus()
+	timeline.add("fees", "stopped")
+}
+
+func (f *FeeMarket) sendWait() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.every
+}
+
+func (f *FeeMarket) sendRound() {
+	f.mu.Lock()
+	n := f.txs
+	f.mu.Unlock()
+	for i := 0; i < n; i++ {
+		f.send(f.rate())
+	}
+	f.showStatus()
+}
+
+// blockWait checks back every second while block mining is off
+func (f *FeeMarket) blockWait() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.blockevery == 0 {
+		return time.Second
+	}
+	return f.blockevery
+}
+
+func (f *FeeMarket) blockRound() {
+	f.mu.Lock()
+	mining := f.blockevery > 0
+	f.mu.Unlock()
+	if mining {
+		f.mineBlock()
+	}
+}
+
+// rate draws a fee rate in sat/vB, exp clusters most transactions near the
+// minimum with a long tail of high payers
+func (f *FeeMarket) rate() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dist == "exp" {
+		r := f.minrate + rand.ExpFloat64()*(f.maxrate-f.minrate)/4
+		if r > f.maxrate {
+			r = f.maxrate
+		}
+		return r
+	}
+	return f.minrate + rand.Float64()*(f.maxrate-f.minrate)
+}
+
+// send pays a small random amount back to the bitcoind wallet at the rate
+func (f *FeeMarket) send(rate float64) error {
+	address, err := btc.GetNewAddress()
+	if err == nil {
+		_, err = btc.SendToAddressFeeRate(address, 0.0001+rand.Float64()*0.001, rate)
+	}
+	f.mu.Lock()
+	if err != nil {
+		f.failed++
+	} else {
+		f.sent++
+	}
+	f.mu.Unlock()
+	return err
+}
+
+// Spike sends a burst of transactions paying around the rate
+func (f *FeeMarket) Spike(rate float64, n int) int {
+	ok := 0
+	for i := 0; i < n; i++ {
+		if f.send(rate*(0.9+rand.Float64()*0.2)) == nil {
+			ok++
+		}
+	}
+	timeline.add("fees", "spike of %d transactions at %.1f sat/vB", ok, rate)
+	f.showStatus()
+	return ok
+}
+
+type mempoolEntry struct {
+	Vsize         int      `json:"vsize"`
+	Ancestorcount int      `json:"ancestorcount"`
+	Ancestorsize  int      `json:"ancestorsize"`
+	Depends       []string `json:"depends"`
+	Fees          struct {
+		Base     float64 `json:"base"`
+		Ancestor float64 `json:"ancestor"`
+	} `json:"fees"`
+}
+
+// mineBlock mines one block holding the highest paying transactions that fit
+// in the block size, choosing by ancestor fee rate like bitcoind does
+func (f *FeeMarket) mineBlock() {
+	f.mu.Lock()
+	size := f.blocksize
+	f.mu.Unlock()
+
+	mempool, err := btc.GetRawMempoolVerbose()
+	if err != nil {
+		timeline.add("fees", "mempool read failed: %s", err.Error())
+		return
+	}
+
+	txids := make([]string, 0, len(mempool))
+	for txid := range mempool {
+		txids = append(txids, txid)
+	}
+	feerate := func(txid string) float64 {
+		e := mempool[txid]
+		return e.Fees.Ancestor / float64(e.Ancestorsize)
+	}
+	sort.Slice(txids, func(i, j int) bool { return feerate(txids[i]) > feerate(txids[j]) })
+
+	selected := make(map[string]bool)
+	block := make([]string, 0)
+	used := 0
+	// include is the transaction with its ancestors not in the block yet,
+	// parents first and each once even when two of them share a parent
+	include := func(txid string) []string {
+		pkg := []string{}
+		seen := make(map[string]bool)
+		var add func(t string)
+		add = func(t string) {
+			if selected[t] || seen[t] {
+				return
+			}
+			seen[t] = true
+			for _, parent := range mempool[t].Depends {
+				add(parent)
+			}
+			pkg = append(pkg, t)
+		}
+		add(txid)
+		return pkg
+	}
+	for _, txid := range txids {
+		pkg := include(txid)
+		vsize := 0
+		for _, t := range pkg {
+			vsize += mempool[t].Vsize
+		}
+		if used+vsize > size {
+			continue
+		}
+		for _, t := range pkg {
+			selected[t] = true
+			block = append(block, t)
+		}
+		used += vsize
+	}
+
+	address, err := btc.GetNewAddress()
+	if err != nil {
+		return
+	}
+	if _, err := btc.GenerateBlock(address, block); err != nil {
+		timeline.add("fees", "generateblock failed: %s", err.Error())
+		return
+	}
+	minrate := 0.0
+	for i, t := range block {
+		rate := mempool[t].Fees.Base * 1e8 / float64(mempool[t].Vsize)
+		if i == 0 || rate < minrate {
+			minrate = rate
+		}
+	}
+	timeline.add("fees", "mined %d of %d mempool transactions, %d vB, lowest %.1f sat/vB", len(block), len(mempool), used, minrate)
+	f.showStatus()
+}
+
+func (f *FeeMarket) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.running {
+		return "fees: off"
+	}
+	return fmt.Sprintf("fees: %.1f-%.1f sat/vB %s, %d sent %d failed", f.minrate, f.maxrate, f.dist, f.sent, f.failed)
+}
+
+func (f *FeeMarket) showStatus() {
+	showAgentStatus("fees", f)
+}
+
+// estimates reports the mempool and what bitcoind estimates for a few
+// confirmation targets, the same estimates lnd sees
+func estimates() string {
+	var b strings.Builder
+	if info, err := btc.GetMempoolInfo(); err == nil {
+		fmt.Fprintf(&b, "mempool: %d transactions, %d vB\n", info.Size, info.Bytes)
+	}
+	for _, target := range []int{1, 3, 6, 12, 144} {
+		est, err := btc.EstimateSmartFee(target)
+		if err != nil {
+			continue
+		}
+		if est.Feerate == 0 {
+			fmt.Fprintf(&b, "estimatesmartfee %d: %s\n", target, strings.Join(est.Errors, ", "))
+			continue
+		}
+		// feerate is BTC/kvB
+		fmt.Fprintf(&b, "estimatesmartfee %d: %.1f sat/vB\n", target, est.Feerate*1e5)
+	}
+	return b.String()
+}
+
+// feesCommand takes key=value settings like chaosCommand, e.g.
+// :fees start min=2 max=80 dist=exp txs=10 every=5s block=30s size=5000
+func feesCommand(args []string) string {
+	if feemarket == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return feemarket.String() + "\n" + estimates()
+	}
+
+	if args[0] == "spike" {
+		rate, n := 100.0, 50
+		for _, arg := range args[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			var err error
+			switch {
+			case len(kv) == 2 && kv[0] == "rate":
+				rate, err = strconv.ParseFloat(kv[1], 64)
+			case len(kv) == 2 && kv[0] == "count":
+				n, err = strconv.Atoi(kv[1])
+			default:
+				return fmt.Sprintf("unknown spike setting %s", arg)
+			}
+			if err != nil {
+				return fmt.Sprintf("invalid spike setting %s", arg)
+			}
+		}
+		ok := feemarket.Spike(rate, n)
+		return fmt.Sprintf("sent %d of %d transactions at ~%.1f sat/vB\n%s", ok, n, rate, estimates())
+	}
+	if args[0] == "mine" {
+		feemarket.mineBlock()
+		return estimates()
+	}
+
+	if err := agentCommand("fees", feemarket, args); err != nil {
+		return err.Error()
+	}
+	return feemarket.String() + "\n" + estimates()
+}
+
+func (f *FeeMarket) set(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch key {
+	case "min", "max":
+		r, err := strconv.ParseFloat(value, 64)
+		if err != nil || r < 0 {
+			return fmt.Errorf("invalid fee rate %s", value)
+		}
+		if key == "min" {
+			f.minrate = r
+		} else {
+			f.maxrate = r
+		}
+		if f.maxrate < f.minrate {
+			f.maxrate = f.minrate
+		}
+	case "dist":
+		if value != "uniform" && value != "exp" {
+			return fmt.Errorf("dist must be uniform or exp")
+		}
+		f.dist = value
+	case "txs", "size":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %s", key, value)
+		}
+		if key == "txs" {
+			f.txs = n
+		} else {
+			f.blocksize = n
+		}
+	case "every", "block":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || (key == "every" && d == 0) {
+			return fmt.Errorf("invalid interval %s", value)
+		}
+		if key == "every" {
+			f.every = d
+		} else {
+			f.blockevery = d
+		}
+	default:
+		return fmt.Errorf("unknown fees setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"strconv"
+	"strings"
+)
+
+// Funding is how much on-chain money a node gets and in what shape, spread
+// over several utxos so coin selection has something to choose from
+type Funding struct {
+	BTC      float64
+	UTXOs    int
+	AddrType string
+}
+
+const FUNDING_BTC = 1.0
+const FUNDING_UTXOS = 1
+
+var addressTypes = []string{"nested", "native", "taproot", "mixed"}
+
+func NewFunding(amount string, utxos string, addrtype string) *Funding {
+	f := &Funding{
+		BTC:      FUNDING_BTC,
+		UTXOs:    FUNDING_UTXOS,
+		AddrType: "nested",
+	}
+	if b, err := strconv.ParseFloat(amount, 64); err == nil && b > 0 {
+		f.BTC = b
+	}
+	if n, err := strconv.Atoi(utxos); err == nil && n > 0 {
+		f.UTXOs = n
+	}
+	if addrtype != "" {
+		f.AddrType = addrtype
+	}
+	return f
+}
+
+// set changes one setting of the funding as given to :fund or at launch
+func (f *Funding) set(key, value string) error {
+	switch key {
+	case "utxos":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid utxo count %s", value)
+		}
+		f.UTXOs = n
+	case "type":
+		for _, t := range addressTypes {
+			if t == value {
+				f.AddrType = value
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown address type %s, use %s", value, strings.Join(addressTypes, ", "))
+	default:
+		return fmt.Errorf("unknown fund setting %s", key)
+	}
+	return nil
+}
+
+// parseFunding reads <btc> [utxos=n] [type=t], settings not given are those
+// of base
+func parseFunding(args []string, base *Funding) (*Funding, error) {
+	b, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || b <= 0 {
+		return nil, fmt.Errorf("invalid amount %s", args[0])
+	}
+	f := *base
+	f.BTC = b
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid setting %s, expected key=value", arg)
+		}
+		if err := f.set(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// parseNodeFunding reads the per node funding entered at launch, entries
+// like the arguments of :fund with the node's number in place of its name,
+// separated by commas: 2 5 utxos=10 type=taproot, 3 0.1
+func parseNodeFunding(text string, base *Funding) (map[int]*Funding, error) {
+	funding := make(map[int]*Funding)
+	for _, entry := range strings.Split(text, ",") {
+		args := strings.Fields(entry)
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) < 2 {
+			return nil, fmt.Errorf("invalid node funding %s, expected <node> <btc> [utxos=n] [type=t]", entry)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid node number %s", args[0])
+		}
+		f, err := parseFunding(args[1:], base)
+		if err != nil {
+			return nil, err
+		}
+		funding[n] = f
+	}
+	return funding, nil
+}
+
+// addressType is the lnd address type of the i-th utxo, mixed cycles through
+// all of them
+func (f *Funding) addressType(i int) (lnrpc.AddressType, error) {
+	t := f.AddrType
+	if t == "mixed" {
+		t = addressTypes[i%(len(addressTypes)-1)]
+	}
+	switch t {
+	case "nested":
+		return lnrpc.AddressType_NESTED_PUBKEY_HASH, nil
+	case "native":
+		return lnrpc.AddressType_WITNESS_PUBKEY_HASH, nil
+	case "taproot":
+		return lnrpc.AddressType_TAPROOT_PUBKEY, nil
+	}
+	return 0, fmt.Errorf("unknown address type %s, use %s", t, strings.Join(addressTypes, ", "))
+}
+
+// fund sends the node its funding in one transaction with an output per utxo
+func fund(a *alias, f *Funding) error {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return fmt.Errorf("cannot connect to %s", *a.Name)
+	}
+	ctx := context.Background()
+
+	amt := f.BTC / float64(f.UTXOs)
+	outputs := make(map[string]float64)
+	for i := 0; i < f.UTXOs; i++ {
+		t, err := f.addressType(i)
+		if err != nil {
+			return err
+		}
+		addr, err := rpc.NewAddress(ctx, &lnrpc.NewAddressRequest{Type: t})
+		if err != nil {
+			return err
+		}
+		outputs[addr.Address] = amt
+	}
+	_, err := btc.SendMany(outputs)
+	return err
+}
+
+// fundCommand parses :fund <node> <btc> [utxos=1] [type=nested]
+func fundCommand(args []string) string {
+	if scenarios == nil {
+		return "network not launched"
+	}
+	if len(args) < 2 {
+		return fmt.Sprintf("usage: fund <node> <btc> [utxos=1] [type=%s]", strings.Join(addressTypes, "|"))
+	}
+	a, ok := scenarios.aliases[args[0]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[0])
+	}
+	f, err := parseFunding(args[1:], NewFunding("", "", ""))
+	if err != nil {
+		return err.Error()
+	}
+
+	if err := fund(a, f); err != nil {
+		return err.Error()
+	}
+	timeline.add("fund", "sent %s %.8f BTC in %d %s utxos", *a.Name, f.BTC, f.UTXOs, f.AddrType)
+	return fmt.Sprintf("sent %s %.8f BTC in %d %s utxos, mine a block to confirm", *a.Name, f.BTC, f.UTXOs, f.AddrType)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/rivo/tview"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Graph draws the nodes on a ring with their channels between them, each
+// channel labeled with its capacity and how the balance is split
+type Graph struct {
+	*tview.Flex
+	aliases  map[string]*alias
+	canvas   *graphCanvas
+	detail   *tview.TextView
+	nodes    []string
+	edges    []*graphEdge
+	selected int
+	visible  bool
+	stop     chan bool
+	mu       sync.Mutex
+}
+
+// graphEdge is a channel seen from A, the node first by name, or a peer
+// connection without a channel when point is empty
+type graphEdge struct {
+	A, B     string
+	point    string
+	chanid   uint64
+	capacity int64
+	local    int64
+	remote   int64
+	active   bool
+	private  bool
+}
+
+type graphCanvas struct {
+	*tview.Box
+	g *Graph
+}
+
+var graph *Graph
+
+const GRAPH_POLL = 3 * time.Second
+
+func NewGraph(aliases map[string]*alias) *Graph {
+	g := &Graph{
+		Flex:    tview.NewFlex().SetDirection(tview.FlexColumn),
+		aliases: aliases,
+		detail:  tview.NewTextView().SetDynamicColors(true),
+	}
+	g.canvas = &graphCanvas{Box: tview.NewBox(), g: g}
+	g.canvas.SetBorder(true).SetTitle("Network (Left/Right select, Enter for details, Ctrl+g to close)")
+	g.detail.SetBorder(true).SetTitle("Details")
+	g.AddItem(g.canvas, 0, 3, true)
+	g.AddItem(g.detail, 0, 2, false)
+
+	g.canvas.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		g.mu.Lock()
+		n := len(g.nodes) + g.channelCount()
+		switch key.Key() {
+		case tcell.KeyRight, tcell.KeyDown:
+			if n > 0 {
+				g.selected = (g.selected + 1) % n
+			}
+		case tcell.KeyLeft, tcell.KeyUp:
+			if n > 0 {
+				g.selected = (g.selected + n - 1) % n
+			}
+		case tcell.KeyEnter:
+			g.mu.Unlock()
+			go g.showDetail()
+			return nil
+		default:
+			g.mu.Unlock()
+			return key
+		}
+		g.mu.Unlock()
+		return nil
+	})
+	return g
+}
+
+func (g *Graph) Show() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.visible {
+		return
+	}
+	g.visible = true
+	g.stop = make(chan bool)
+	stop := g.stop
+	go (func() {
+		for {
+			g.refresh()
+			select {
+			case <-stop:
+				return
+			case <-time.After(GRAPH_POLL):
+			}
+		}
+	})()
+}
+
+func (g *Graph) Hide() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.visible {
+		return
+	}
+	g.visible = false
+	close(g.stop)
+}
+
+// refresh collects every node's channels, each channel once, and the peer
+// connections made at launch that have no channel
+func (g *Graph) refresh() {
+	nodes := sortAliasKeys(g.aliases)
+	edges := []*graphEdge{}
+	// by channel point, with alias scids each side has its own chan_id
+	seen := make(map[string]bool)
+	linked := make(map[string]bool)
+	ctx := context.Background()
+	for _, name := range nodes {
+		a := g.aliases[name]
+		rpc := grpcClient(a)
+		if rpc == nil {
+			continue
+		}
+		chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		for _, c := range chans.Channels {
+			if seen[c.ChannelPoint] {
+				continue
+			}
+			peer := aliasByPubkey(g.aliases, c.RemotePubkey)
+			if peer == nil {
+				continue
+			}
+			seen[c.ChannelPoint] = true
+			e := &graphEdge{A: name, B: *peer.Name, point: c.ChannelPoint, chanid: c.ChanId, capacity: c.Capacity,
+				local: c.LocalBalance, remote: c.RemoteBalance, active: c.Active, private: c.Private}
+			if e.B < e.A {
+				e.A, e.B = e.B, e.A
+				e.local, e.remote = e.remote, e.local
+			}
+			linked[e.A+" "+e.B] = true
+			edges = append(edges, e)
+		}
+	}
+	for _, a := range nodes {
+		for _, b := range connectedTo(a) {
+			x, y := a, b
+			if y < x {
+				x, y = y, x
+			}
+			if !linked[x+" "+y] {
+				linked[x+" "+y] = true
+				edges = append(edges, &graphEdge{A: x, B: y})
+			}
+		}
+	}
+	sort.SliceStable(edges, func(i, j int) bool {
+		return edges[i].point != "" && edges[j].point == ""
+	})
+
+	g.mu.Lock()
+	g.nodes = nodes
+	g.edges = edges
+	if g.selected >= len(nodes)+g.channelCount() {
+		g.selected = 0
+	}
+	g.mu.Unlock()
+	app.Draw()
+}
+
+// channelCount is the number of edges that are channels, they come first
+func (g *Graph) channelCount() int {
+	n := 0
+	for _, e := range g.edges {
+		if e.point != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (g *Graph) showDetail() {
+	g.mu.Lock()
+	var node string
+	var edge *graphEdge
+	if g.selected < len(g.nodes) {
+		node = g.nodes[g.selected]
+	} else if i := g.selected - len(g.nodes); i < len(g.edges) {
+		edge = g.edges[i]
+	}
+	g.mu.Unlock()
+
+	switch {
+	case node != "":
+		d := &Dashboard{aliases: g.aliases}
+		g.detail.SetText(d.render(g.aliases[node]))
+	case edge != nil:
+		g.detail.SetText(g.channelDetail(edge))
+	}
+	g.detail.ScrollToBeginning()
+	app.Draw()
+}
+
+func (g *Graph) channelDetail(e *graphEdge) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "[yellow]%s - %s[white]\n%s\nscid %s, capacity %d sat\n", e.A, e.B, e.point, scidString(e.chanid), e.capacity)
+	fmt.Fprintf(&s, "%s %d sat\n%s %d sat\n%s\n", e.A, e.local, e.B, e.remote, balanceBar(e.local, e.remote))
+	if !e.active {
+		s.WriteString("[red]inactive[white]\n")
+	}
+	if e.private {
+		s.WriteString("private, not in the graph\n")
+		return s.String()
+	}
+	rpc := grpcClient(g.aliases[e.A])
+	if rpc == nil {
+		return s.String()
+	}
+	edge, err := rpc.GetChanInfo(context.Background(), &lnrpc.ChanInfoRequest{ChanId: e.chanid})
+	if err != nil {
+		fmt.Fprintf(&s, "%s\n", tview.Escape(err.Error()))
+		return s.String()
+	}
+	policies := []*lnrpc.RoutingPolicy{edge.Node1Policy, edge.Node2Policy}
+	for i, pubkey := range []string{edge.Node1Pub, edge.Node2Pub} {
+		p := policies[i]
+		if p == nil {
+			continue
+		}
+		name := pubkey[:12]
+		if a := aliasByPubkey(g.aliases, pubkey); a != nil {
+			name = *a.Name
+		}
+		fmt.Fprintf(&s, "\n[yellow]%s policy[white]\nbase fee %d msat, fee rate %d ppm, time lock delta %d\nmin htlc %d msat, max htlc %d msat, disabled %t\n",
+			name, p.FeeBaseMsat, p.FeeRateMilliMsat, p.TimeLockDelta, p.MinHtlc, p.MaxHtlcMsat, p.Disabled)
+	}
+	return s.String()
+}
+
+// Draw lays the nodes out on an ellipse filling the pane, then draws the
+// edges, their labels and the node boxes on top
+func (c *graphCanvas) Draw(screen tcell.Screen) {
+	c.Box.Draw(screen)
+	x, y, w, h := c.GetInnerRect()
+	g := c.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.nodes) == 0 {
+		tview.Print(screen, "loading...", x, y, w, tview.AlignCenter, tcell.ColorWhite)
+		return
+	}
+
+	widest := 0
+	for _, n := range g.nodes {
+		if len(n) > widest {
+			widest = len(n)
+		}
+	}
+	cx, cy := x+w/2, y+h/2
+	rx := float64(w/2 - widest/2 - 2)
+	ry := float64(h/2 - 2)
+	pos := make(map[string][2]int)
+	for i, n := range g.nodes {
+		angle := 2*math.Pi*float64(i)/float64(len(g.nodes)) - math.Pi/2
+		pos[n] = [2]int{cx + int(math.Round(rx*math.Cos(angle))), cy + int(math.Round(ry*math.Sin(angle)))}
+	}
+
+	for i, e := range g.edges {
+		color := tcell.ColorGreen
+		switch {
+		case e.point == "":
+			color = tcell.ColorGray
+		case len(g.nodes)+i == g.selected:
+			color = tcell.ColorYellow
+		case !e.active:
+			color = tcell.ColorRed
+		}
+		drawLine(screen, pos[e.A], pos[e.B], color, e.point == "")
+	}
+	for i, e := range g.edges {
+		if e.point == "" {
+			continue
+		}
+		color := tcell.ColorWhite
+		if len(g.nodes)+i == g.selected {
+			color = tcell.ColorYellow
+		}
+		a, b := pos[e.A], pos[e.B]
+		label := fmt.Sprintf("%dk %s", e.capacity/1000, splitLabel(e.local, e.remote))
+		tview.Print(screen, label, (a[0]+b[0])/2-len(label)/2, (a[1]+b[1])/2, len(label), tview.AlignLeft, color)
+	}
+	for i, n := range g.nodes {
+		color := tcell.ColorWhite
+		if i == g.selected {
+			color = tcell.ColorYellow
+		}
+		drawBox(screen, pos[n], n, color)
+	}
+}
+
+// splitLabel shows the share of the balance on each side, A's first
+func splitLabel(local, remote int64) string {
+	total := local + remote
+	if total == 0 {
+		return "0|0"
+	}
+	l := int((local*10 + total/2) / total)
+	return fmt.Sprintf("%s|%s", strings.Repeat("<", l), strings.Repeat(">", 10-l))
+}
+
+func drawLine(screen tcell.Screen, from, to [2]int, color tcell.Color, dotted bool) {
+	style := tcell.StyleDefault.Foreground(color)
+	dx, dy := to[0]-from[0], to[1]-from[1]
+	ch := '-'
+	switch {
+	case dotted:
+		ch = '.'
+	case dx == 0 || math.Abs(float64(dy)/float64(dx)) > 2:
+		ch = '|'
+	case math.Abs(float64(dy)/float64(dx)) > 0.25 && (dx > 0) == (dy > 0):
+		ch = '\\'
+	case math.Abs(float64(dy)/float64(dx)) > 0.25:
+		ch = '/'
+	}
+	steps := max(abs(dx), abs(dy))
+	for i := 0; i <= steps; i++ {
+		px := from[0] + int(math.Round(float64(dx*i)/float64(steps)))
+		py := from[1] + int(math.Round(float64(dy*i)/float64(steps)))
+		screen.SetContent(px, py, ch, nil, style)
+	}
+}
+
+func drawBox(screen tcell.Screen, center [2]int, label string, color tcell.Color) {
+	style := tcell.StyleDefault.Foreground(color)
+	w := len(label) + 2
+	left, top := center[0]-w/2, center[1]-1
+	for i := 1; i < w-1; i++ {
+		screen.SetContent(left+i, top, '─', nil, style)
+		screen.SetContent(left+i, top+2, '─', nil, style)
+		screen.SetContent(left+i, top+1, ' ', nil, style)
+	}
+	screen.SetContent(left, top, '┌', nil, style)
+	screen.SetContent(left+w-1, top, '┐', nil, style)
+	screen.SetContent(left, top+2, '└', nil, style)
+	screen.SetContent(left+w-1, top+2, '┘', nil, style)
+	screen.SetContent(left, top+1, '│', nil, style)
+	screen.SetContent(left+w-1, top+1, '│', nil, style)
+	tview.Print(screen, label, left+1, top+1, len(label), tview.AlignLeft, color)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
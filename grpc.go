@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/macaroons"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -10,9 +12,46 @@ import (
 	"io/ioutil"
 	"os/user"
 	"path"
+	"sync"
+	"time"
 )
 
+// connections are kept per node so background agents polling the nodes
+// don't open a new connection on every call
+var conns = make(map[string]*grpc.ClientConn)
+var connsMu sync.Mutex
+
 func grpcClient(a *alias) lnrpc.LightningClient {
+	conn := grpcConn(a)
+	if conn == nil {
+		return nil
+	}
+	return lnrpc.NewLightningClient(conn)
+}
+
+// invoicesClient is for hold invoices, lnd serves it on the same port
+func invoicesClient(a *alias) invoicesrpc.InvoicesClient {
+	conn := grpcConn(a)
+	if conn == nil {
+		return nil
+	}
+	return invoicesrpc.NewInvoicesClient(conn)
+}
+
+// GRPC_DIAL_TIMEOUT bounds the dial to a node, a stopped node fails instead
+// of blocking every caller
+const GRPC_DIAL_TIMEOUT = 5 * time.Second
+
+// grpcConn returns the node's cached connection or dials it. The dial runs
+// outside the lock so a node that is down only holds up its own callers
+func grpcConn(a *alias) *grpc.ClientConn {
+	connsMu.Lock()
+	conn, ok := conns[*a.Name]
+	connsMu.Unlock()
+	if ok {
+		return conn
+	}
+
 	usr, err := user.Current()
 	if err != nil {
 		logger.logerr("current user fail", err.Error())
@@ -45,27 +84,48 @@ func grpcClient(a *alias) lnrpc.LightningClient {
 	}
 
 	host := fmt.Sprintf("localhost:%d", a.Port)
-	conn, err := grpc.Dial(host, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), GRPC_DIAL_TIMEOUT)
+	defer cancel()
+	conn, err = grpc.DialContext(ctx, host, opts...)
 	if err != nil {
 		logger.logerr("problem with grpc connection", err.Error())
 		return nil
 	}
-	client := lnrpc.NewLightningClient(conn)
-	return client
+
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if cached, ok := conns[*a.Name]; ok {
+		// another caller dialed first
+		conn.Close()
+		return cached
+	}
+	conns[*a.Name] = conn
+	return conn
+}
+
+// dropConn closes a node's cached connection so the next call dials again
+func dropConn(a *alias) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if conn, ok := conns[*a.Name]; ok {
+		conn.Close()
+		delete(conns, *a.Name)
+	}
 }
 
-func unlocker(a *alias) lnrpc.WalletUnlockerClient {
+// unlocker dials the node's wallet unlocker, the caller closes the conn
+func unlocker(a *alias) (lnrpc.WalletUnlockerClient, *grpc.ClientConn) {
 	usr, err := user.Current()
 	if err != nil {
 		fmt.Println("Cannot get current user:", err)
-		return nil
+		return nil, nil
 	}
 	tlsCertPath := path.Join(usr.HomeDir, ".lnd/tls.cert")
 
 	tlsCreds, err := credentials.NewClientTLSFromFile(tlsCertPath, "")
 	if err != nil {
 		fmt.Println("Cannot get node tls credentials", err)
-		return nil
+		return nil, nil
 	}
 
 	opts := []grpc.DialOption{
@@ -74,12 +134,28 @@ func unlocker(a *alias) lnrpc.WalletUnlockerClient {
 	}
 
 	host := fmt.Sprintf("localhost:%d", a.Port)
-	conn, err := grpc.Dial(host, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), GRPC_DIAL_TIMEOUT)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, host, opts...)
 	if err != nil {
-		fmt.Println("cannot dial to lnd", err)
-		return nil
+		return nil, nil
 	}
-	client := lnrpc.NewWalletUnlockerClient(conn)
+	return lnrpc.NewWalletUnlockerClient(conn), conn
+}
 
-	return client
+// UNLOCKER_DIALS is how often a starting lnd is dialed before giving up,
+// each dial waits up to GRPC_DIAL_TIMEOUT
+const UNLOCKER_DIALS = 12
+
+// UNLOCK_TIMEOUT bounds unlocking the wallet once the unlocker is up
+const UNLOCK_TIMEOUT = 30 * time.Second
+
+// waitUnlocker dials a starting lnd until its unlocker answers
+func waitUnlocker(a *alias) (lnrpc.WalletUnlockerClient, *grpc.ClientConn) {
+	for i := 0; i < UNLOCKER_DIALS; i++ {
+		if ln, conn := unlocker(a); ln != nil {
+			return ln, conn
+		}
+	}
+	return nil, nil
 }
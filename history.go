@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gdamore/tcell"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// History keeps the commands entered at the cli on disk, one file per node
+// and one for every node together. It lives outside ~/.lndev which is
+// removed on exit. Nodes get new random names each launch so lnd nodes are
+// kept by their userN number, the Nth node finds the history of the Nth
+// node of earlier sessions. Names in the commands are saved as <userN> and
+// given the current names back when read
+type History struct {
+	dir    string
+	global []string
+	lines  map[string]int
+	names  map[int]string
+	mu     sync.Mutex
+}
+
+const HISTORY_DIR = ".lndev-history"
+const HISTORY_GLOBAL = "global"
+const HISTORY_MAX = 1000
+
+var history *History
+
+var savedName = regexp.MustCompile(`<user(\d+)>`)
+
+func NewHistory(dir string) *History {
+	ensureDir(dir)
+	h := &History{
+		dir:   dir,
+		lines: make(map[string]int),
+		names: make(map[int]string),
+	}
+	h.global = h.load(HISTORY_GLOBAL)
+	return h
+}
+
+// setNames gives the history this session's lnd node names
+func (h *History) setNames(aliases map[string]*alias) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, a := range aliases {
+		if a.Port != 0 {
+			h.names[a.index()] = *a.Name
+		}
+	}
+}
+
+// encode replaces the node names in a command with <userN>, longest names
+// first so a name inside another is left alone
+func (h *History) encode(text string) string {
+	ns := make([]int, 0, len(h.names))
+	for n := range h.names {
+		ns = append(ns, n)
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return len(h.names[ns[i]]) > len(h.names[ns[j]])
+	})
+	for _, n := range ns {
+		text = replaceWord(text, h.names[n], fmt.Sprintf("<user%d>", n))
+	}
+	return text
+}
+
+// decode puts the current names back, it is false when the command names a
+// node this session does not have
+func (h *History) decode(text string) (string, bool) {
+	ok := true
+	text = savedName.ReplaceAllStringFunc(text, func(m string) string {
+		n, _ := strconv.Atoi(savedName.FindStringSubmatch(m)[1])
+		name, found := h.names[n]
+		if !found {
+			ok = false
+		}
+		return name
+	})
+	return text, ok
+}
+
+// replaceWord replaces word where it is not part of a longer word
+func replaceWord(text, word, repl string) string {
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(text, word)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[i+len(word):])
+		b.WriteString(text[:i])
+		if i > 0 && isWord(before) || i+len(word) < len(text) && isWord(after) {
+			b.WriteString(word)
+		} else {
+			b.WriteString(repl)
+		}
+		text = text[i+len(word):]
+	}
+}
+
+// historyKey is the file a node's history is kept in
+func historyKey(a *alias) string {
+	if a.Port == 0 {
+		return *a.Name
+	}
+	return fmt.Sprintf("user%d", a.index())
+}
+
+// load reads a history file as saved, trimming it to the last HISTORY_MAX
+// commands
+func (h *History) load(key string) []string {
+	p := path.Join(h.dir, key)
+	f, err := os.Open(p)
+	if err != nil {
+		return []string{}
+	}
+	defer f.Close()
+	cmds := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			cmds = append(cmds, line)
+		}
+	}
+	if len(cmds) > HISTORY_MAX {
+		cmds = cmds[len(cmds)-HISTORY_MAX:]
+		ioutil.WriteFile(p, []byte(strings.Join(cmds, "\n")+"\n"), 0600)
+	}
+	h.lines[key] = len(cmds)
+	return cmds
+}
+
+// restore gives the node its saved commands so up and down reach them,
+// leaving out those naming nodes this session does not have
+func (h *History) restore(n *node, key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n.Cmds = []string{}
+	for _, c := range h.load(key) {
+		if c, ok := h.decode(c); ok {
+			n.Cmds = append(n.Cmds, c)
+		}
+	}
+	if len(n.Cmds) > 0 {
+		*n.CmdIndex = len(n.Cmds)
+	}
+}
+
+// add appends the command to the node's history and the global one, a file
+// going over HISTORY_MAX is trimmed again
+func (h *History) add(key string, text string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	text = h.encode(text)
+	h.global = append(h.global, text)
+	if len(h.global) > HISTORY_MAX {
+		h.global = h.global[len(h.global)-HISTORY_MAX:]
+	}
+	for _, k := range []string{key, HISTORY_GLOBAL} {
+		f, err := os.OpenFile(path.Join(h.dir, k), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintln(f, text)
+		f.Close()
+		if h.lines[k]++; h.lines[k] > HISTORY_MAX {
+			h.load(k)
+		}
+	}
+}
+
+// search finds the skip-th most recent command containing the query, the
+// node's own commands first and then those of every node
+func (h *History) search(local []string, query string, skip int) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := make(map[string]bool)
+	global := make([]string, 0, len(h.global))
+	for _, c := range h.global {
+		if c, ok := h.decode(c); ok {
+			global = append(global, c)
+		}
+	}
+	for _, cmds := range [][]string{local, global} {
+		for i := len(cmds) - 1; i >= 0; i-- {
+			c := cmds[i]
+			if seen[c] || !strings.Contains(c, query) {
+				continue
+			}
+			seen[c] = true
+			if skip == 0 {
+				return c, true
+			}
+			skip--
+		}
+	}
+	return "", false
+}
+
+// reverseSearch is the state of ctrl+r on the cli, like readline's
+type reverseSearch struct {
+	query string
+	skip  int
+	saved string
+}
+
+func (u *MainUI) startReverseSearch() {
+	u.rsearch = &reverseSearch{saved: u.cli.GetText()}
+	u.findReverse()
+}
+
+// findReverse shows the match for the query, or keeps the last one shown
+// when there is none
+func (u *MainUI) findReverse() {
+	r := u.rsearch
+	match, ok := history.search(u.nodes[u.currentnode].Cmds, r.query, r.skip)
+	if !ok && r.skip > 0 {
+		r.skip--
+		match, ok = history.search(u.nodes[u.currentnode].Cmds, r.query, r.skip)
+	}
+	if ok {
+		u.cli.SetLabel(fmt.Sprintf("(reverse-i-search)`%s': ", r.query))
+		u.cli.SetText(match)
+	} else {
+		u.cli.SetLabel(fmt.Sprintf("(failed reverse-i-search)`%s': ", r.query))
+	}
+}
+
+func (u *MainUI) endReverseSearch() {
+	u.rsearch = nil
+	u.cli.SetLabel("")
+}
+
+// reverseSearchKey handles a key while searching, keys that end the search
+// are passed on so enter runs the match
+func (u *MainUI) reverseSearchKey(key *tcell.EventKey) *tcell.EventKey {
+	r := u.rsearch
+	switch key.Key() {
+	case tcell.KeyRune:
+		r.query += string(key.Rune())
+		r.skip = 0
+		u.findReverse()
+		return nil
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(r.query) > 0 {
+			_, size := utf8.DecodeLastRuneInString(r.query)
+			r.query = r.query[:len(r.query)-size]
+			r.skip = 0
+			u.findReverse()
+		}
+		return nil
+	case tcell.KeyCtrlR:
+		r.skip++
+		u.findReverse()
+		return nil
+	case tcell.KeyEscape:
+		u.cli.SetText(r.saved)
+		u.endReverseSearch()
+		return nil
+	case tcell.KeyLeft, tcell.KeyRight, tcell.KeyHome, tcell.KeyEnd, tcell.KeyUp, tcell.KeyDown:
+		// keep the match to edit it
+		u.endReverseSearch()
+		return nil
+	}
+	u.endReverseSearch()
+	return key
+}
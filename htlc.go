@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HTLC_AMOUNT = 10000
+const HTLC_CLTV = 40
+const HTLC_MAX_BLOCKS = 500
+
+// lnd goes on chain for an incoming htlc this many blocks before it expires,
+// blocks are mined one at a time from a little before that
+const HTLC_BROADCAST_DELTA = 10
+const HTLC_STEP_MARGIN = 2
+
+// lnd cancels an accepted hold invoice back invoices.holdexpirydelta blocks
+// before it expires, which it requires to be more than the broadcast delta.
+// A receiver that is online fails the htlc off-chain, so only an offline one
+// leaves it stuck until the channels go on chain
+const HTLC_DEFAULT_MODE = "offline"
+
+// hopStage is where the htlc is for one side of a channel
+type hopStage int
+
+const (
+	HOP_IN_CHANNEL hopStage = iota
+	HOP_REMOVED
+	HOP_CLOSING
+	HOP_FORCE_CLOSED
+	HOP_CLOSED
+)
+
+type htlcOptions struct {
+	mode   string
+	amount int64
+	cltv   uint64
+	blocks int
+}
+
+// htlcHop is one side of a channel the stuck htlc went through
+type htlcHop struct {
+	node     *alias
+	point    string
+	incoming bool
+	expiry   uint32
+	stage    hopStage
+	// matures is the earliest height a timelocked htlc output of a force
+	// closed channel can be swept
+	matures int
+	state   string
+	done    bool
+}
+
+func (h *htlcHop) String() string {
+	dir := "outgoing"
+	if h.incoming {
+		dir = "incoming"
+	}
+	return fmt.Sprintf("%s %s htlc on %s", *h.node.Name, dir, h.point)
+}
+
+// StuckHTLC pays a hold invoice that is never settled, with mode=offline the
+// receiver is also stopped once it has the htlc, with mode=hold it stays
+// online and cancels the htlc back before it expires. Blocks are then mined past
+// the cltv expiry and every hop is followed through the force closes, htlc
+// timeout transactions and sweeps until it is resolved
+func (s *Scenarios) StuckHTLC(sender, receiver *alias, opts *htlcOptions) (string, error) {
+	var report strings.Builder
+	step := func(format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		timeline.add("htlc", "%s", msg)
+		report.WriteString(msg + "\n")
+	}
+
+	srcrpc := grpcClient(sender)
+	destrpc := grpcClient(receiver)
+	invoices := invoicesClient(receiver)
+	if srcrpc == nil || destrpc == nil || invoices == nil {
+		return "", fmt.Errorf("cannot connect to %s or %s", *sender.Name, *receiver.Name)
+	}
+	ctx := context.Background()
+
+	preimage := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(preimage)
+	inv, err := invoices.AddHoldInvoice(ctx, &invoicesrpc.AddHoldInvoiceRequest{
+		Memo:       "stuck htlc scenario",
+		Hash:       hash[:],
+		Value:      opts.amount,
+		CltvExpiry: opts.cltv,
+	})
+	if err != nil {
+		return "", err
+	}
+	step("%s created hold invoice %x for %d sat, cltv %d", *receiver.Name, hash[:4], opts.amount, opts.cltv)
+
+	result := make(chan string, 1)
+	go (func() {
+		resp, err := srcrpc.SendPaymentSync(context.Background(), &lnrpc.SendRequest{PaymentRequest: inv.PaymentRequest})
+		switch {
+		case err != nil:
+			result <- err.Error()
+		case resp.PaymentError != "":
+			result <- resp.PaymentError
+		default:
+			result <- "settled"
+		}
+	})()
+
+	if err := waitAccepted(destrpc, hash[:], result); err != nil {
+		return report.String(), err
+	}
+	hops := findHops(s.aliases, hash[:])
+	if len(hops) == 0 {
+		return report.String(), fmt.Errorf("cannot find the htlc in any channel")
+	}
+	for _, h := range hops {
+		h.stage = HOP_IN_CHANNEL
+		h.state = fmt.Sprintf("in channel, expires at %d", h.expiry)
+		step("%s: %s", h, h.state)
+	}
+
+	// the receiver can't be asked while it is offline, its side is checked
+	// once it is back
+	watched := hops
+	if opts.mode == "offline" {
+		if err := stopLnd(receiver); err != nil {
+			return report.String(), err
+		}
+		step("%s is offline and won't settle or fail the htlc", *receiver.Name)
+		watched = []*htlcHop{}
+		for _, h := range hops {
+			if h.node != receiver {
+				watched = append(watched, h)
+			}
+		}
+	}
+
+	height, err := btc.GetBlockCount()
+	if err != nil {
+		return report.String(), err
+	}
+	limit := height + opts.blocks
+	for height < limit && !allResolved(watched) {
+		n := blocksToNext(watched, height)
+		if height+n > limit {
+			n = limit - height
+		}
+		hashes := s.launcher.generate(n)
+		height += n
+		time.Sleep(2 * time.Second)
+
+		index := newChanIndex(s.aliases)
+		for _, bh := range hashes {
+			block, err := btc.GetBlock(bh)
+			if err != nil {
+				continue
+			}
+			for _, tx := range block.Tx[1:] {
+				if label := index.label(tx); label != "wallet" {
+					step("block %d: %s %s", block.Height, label, tx.Txid)
+				}
+			}
+		}
+		for _, h := range watched {
+			state := h.state
+			hopState(h, hash[:])
+			if state != h.state {
+				step("block %d: %s: %s", height, h, h.state)
+			}
+		}
+	}
+
+	select {
+	case r := <-result:
+		step("payment from %s: %s", *sender.Name, r)
+	default:
+		step("payment from %s still in flight", *sender.Name)
+	}
+	if !allResolved(watched) {
+		step("not every hop was resolved after %d blocks", opts.blocks)
+	}
+
+	if opts.mode == "offline" {
+		if err := startLnd(receiver); err != nil {
+			return report.String(), err
+		}
+		step("%s is back online", *receiver.Name)
+		for _, h := range hops {
+			if h.node == receiver {
+				hopState(h, hash[:])
+				step("%s: %s", h, h.state)
+			}
+		}
+	}
+	if invoices := invoicesClient(receiver); invoices != nil {
+		invoices.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: hash[:]})
+	}
+	return report.String(), nil
+}
+
+// waitAccepted waits until the receiver holds the htlc, or the payment fails
+func waitAccepted(rpc lnrpc.LightningClient, hash []byte, result chan string) error {
+	deadline := time.Now().Add(SCENARIO_TIMEOUT)
+	for time.Now().Before(deadline) {
+		select {
+		case r := <-result:
+			return fmt.Errorf("payment ended before the htlc was held: %s", r)
+		default:
+		}
+		inv, err := rpc.LookupInvoice(context.Background(), &lnrpc.PaymentHash{RHash: hash})
+		if err == nil && inv.State == lnrpc.Invoice_ACCEPTED {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("the receiver did not accept the htlc")
+}
+
+// findHops returns both sides of every channel holding the htlc
+func findHops(aliases map[string]*alias, hash []byte) []*htlcHop {
+	hops := []*htlcHop{}
+	for _, a := range aliases {
+		rpc := grpcClient(a)
+		if rpc == nil {
+			continue
+		}
+		chans, err := rpc.ListChannels(context.Background(), &lnrpc.ListChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		for _, c := range chans.Channels {
+			for _, h := range c.PendingHtlcs {
+				if bytes.Equal(h.HashLock, hash) {
+					hops = append(hops, &htlcHop{node: a, point: c.ChannelPoint, incoming: h.Incoming, expiry: h.ExpirationHeight})
+				}
+			}
+		}
+	}
+	// from the sender along the route
+	sort.Slice(hops, func(i, j int) bool {
+		if hops[i].expiry != hops[j].expiry {
+			return hops[i].expiry > hops[j].expiry
+		}
+		return !hops[i].incoming && hops[j].incoming
+	})
+	return hops
+}
+
+// hopState updates where the htlc is for one side of a channel, and whether
+// that is final. The hop is left as it was when the node can't be asked
+func hopState(h *htlcHop, hash []byte) {
+	rpc := grpcClient(h.node)
+	if rpc == nil {
+		return
+	}
+	ctx := context.Background()
+
+	chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		return
+	}
+	for _, c := range chans.Channels {
+		if c.ChannelPoint != h.point {
+			continue
+		}
+		for _, p := range c.PendingHtlcs {
+			if bytes.Equal(p.HashLock, hash) {
+				h.set(HOP_IN_CHANNEL, fmt.Sprintf("in channel, expires at %d", p.ExpirationHeight), false)
+				return
+			}
+		}
+		h.set(HOP_REMOVED, "removed off-chain", true)
+		return
+	}
+
+	pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{})
+	if err != nil {
+		return
+	}
+	for _, w := range pending.WaitingCloseChannels {
+		if w.Channel.ChannelPoint == h.point {
+			h.set(HOP_CLOSING, fmt.Sprintf("channel closing, waiting for %s to confirm", w.ClosingTxid), false)
+			return
+		}
+	}
+	for _, f := range pending.PendingForceClosingChannels {
+		if f.Channel.ChannelPoint != h.point {
+			continue
+		}
+		if len(f.PendingHtlcs) == 0 {
+			h.set(HOP_FORCE_CLOSED, fmt.Sprintf("force closed by %s, htlc resolved, %d sat in limbo", f.ClosingTxid, f.LimboBalance), true)
+			return
+		}
+		states := []string{}
+		h.matures = -1
+		for _, p := range f.PendingHtlcs {
+			states = append(states, fmt.Sprintf("stage %d output %s matures at %d", p.Stage, p.Outpoint, p.MaturityHeight))
+			if h.matures == -1 || int(p.MaturityHeight) < h.matures {
+				h.matures = int(p.MaturityHeight)
+			}
+		}
+		h.set(HOP_FORCE_CLOSED, fmt.Sprintf("force closed by %s, %s", f.ClosingTxid, strings.Join(states, ", ")), false)
+		return
+	}
+
+	closed, err := rpc.ClosedChannels(ctx, &lnrpc.ClosedChannelsRequest{})
+	if err != nil {
+		return
+	}
+	for _, c := range closed.Channels {
+		if c.ChannelPoint != h.point {
+			continue
+		}
+		states := []string{}
+		for _, r := range c.Resolutions {
+			if r.ResolutionType != lnrpc.ResolutionType_INCOMING_HTLC && r.ResolutionType != lnrpc.ResolutionType_OUTGOING_HTLC {
+				continue
+			}
+			state := fmt.Sprintf("%s %s %d sat", r.ResolutionType, r.Outcome, r.AmountSat)
+			if r.SweepTxid != "" {
+				state += " by " + r.SweepTxid
+			}
+			states = append(states, state)
+		}
+		if len(states) == 0 {
+			states = append(states, "no htlc resolution recorded")
+		}
+		h.set(HOP_CLOSED, fmt.Sprintf("closed %s, %s", c.CloseType, strings.Join(states, ", ")), true)
+		return
+	}
+}
+
+func (h *htlcHop) set(stage hopStage, state string, done bool) {
+	h.stage, h.state, h.done = stage, state, done
+}
+
+func allResolved(hops []*htlcHop) bool {
+	for _, h := range hops {
+		if !h.done {
+			return false
+		}
+	}
+	return true
+}
+
+// blocksToNext skips ahead to a little before the next height where lnd acts,
+// an htlc going on chain or a timelocked output maturing
+func blocksToNext(hops []*htlcHop, height int) int {
+	next := -1
+	for _, h := range hops {
+		target := -1
+		switch {
+		case h.done:
+			continue
+		case h.stage == HOP_IN_CHANNEL:
+			target = int(h.expiry) - HTLC_BROADCAST_DELTA - HTLC_STEP_MARGIN
+		case h.stage == HOP_FORCE_CLOSED && h.matures > 0:
+			target = h.matures - HTLC_STEP_MARGIN
+		}
+		if target > height && (next == -1 || target < next) {
+			next = target
+		}
+	}
+	if next <= height+1 {
+		return 1
+	}
+	return next - height
+}
+
+// htlcCommand parses :htlc <sender> <receiver> [mode=offline|hold]
+// [amount=10000] [cltv=40] [blocks=500]
+func htlcCommand(args []string) string {
+	if scenarios == nil {
+		return "network not launched"
+	}
+	if len(args) < 2 {
+		return "usage: htlc <sender> <receiver> [mode=offline|hold] [amount=10000] [cltv=40] [blocks=500]"
+	}
+	sender, ok := scenarios.aliases[args[0]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[0])
+	}
+	receiver, ok := scenarios.aliases[args[1]]
+	if !ok {
+		return fmt.Sprintf("unknown node %s", args[1])
+	}
+	if sender == receiver {
+		return "sender and receiver must be different nodes"
+	}
+
+	opts := &htlcOptions{mode: HTLC_DEFAULT_MODE, amount: HTLC_AMOUNT, cltv: HTLC_CLTV, blocks: HTLC_MAX_BLOCKS}
+	for _, arg := range args[2:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Sprintf("invalid setting %s, expected key=value", arg)
+		}
+		switch kv[0] {
+		case "mode":
+			if kv[1] != "hold" && kv[1] != "offline" {
+				return fmt.Sprintf("unknown mode %s, use hold or offline", kv[1])
+			}
+			opts.mode = kv[1]
+		case "amount":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || n < 1 {
+				return fmt.Sprintf("invalid amount %s", kv[1])
+			}
+			opts.amount = n
+		case "cltv":
+			n, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil || n < 18 {
+				return fmt.Sprintf("invalid cltv %s, lnd needs at least 18", kv[1])
+			}
+			opts.cltv = n
+		case "blocks":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return fmt.Sprintf("invalid block count %s", kv[1])
+			}
+			opts.blocks = n
+		default:
+			return fmt.Sprintf("unknown htlc setting %s", kv[0])
+		}
+	}
+
+	report, err := scenarios.StuckHTLC(sender, receiver, opts)
+	if err != nil {
+		timeline.add("htlc", "failed: %s", err.Error())
+		return fmt.Sprintf("%shtlc scenario failed: %s", report, err.Error())
+	}
+	return report
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VARIABLE_PREFIX starts a value expanded in a command before it runs,
+// $Smith.pubkey, $Smith.host, $last.payment_request or $last.json.a.b
+const VARIABLE_PREFIX = "$"
+
+var variablePattern = regexp.MustCompile(`\$([A-Za-z][A-Za-z0-9_-]*)((?:\.[A-Za-z0-9_]+)*)`)
+
+// node fields a variable can name
+var variableFields = []string{"pubkey", "host", "rpc"}
+
+// output of the last command run on any node
+var lastOutput string
+var lastOutputMu sync.Mutex
+
+func setLastOutput(out string) {
+	lastOutputMu.Lock()
+	defer lastOutputMu.Unlock()
+	lastOutput = out
+}
+
+// interpolate replaces every variable in the command, a variable that
+// cannot be expanded fails the whole command so nothing runs half filled in.
+// Values are escaped so each one stays a single argument, \$ or $$ is a
+// literal $
+func interpolate(text string, aliases map[string]*alias) (string, error) {
+	var b strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case (c == '$' || c == '\\') && i+1 < len(text) && text[i+1] == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case c == '$':
+			m := variablePattern.FindStringSubmatchIndex(text[i:])
+			if m == nil || m[0] != 0 {
+				break
+			}
+			v := text[i : i+m[1]]
+			var path []string
+			if m[4] != m[5] {
+				path = strings.Split(text[i+m[4]+1:i+m[5]], ".")
+			}
+			value, err := variableValue(text[i+m[2]:i+m[3]], path, aliases)
+			if err == nil {
+				value, err = quoteValue(value, quote, b.Len() == 0)
+			}
+			if err != nil {
+				return text, fmt.Errorf("%s: %s", v, err)
+			}
+			b.WriteString(value)
+			i += m[1] - 1
+			continue
+		case i == 0:
+			// the command line parser takes the first character as is
+		case c == '\\' && quote == 0 && i+1 < len(text):
+			b.WriteByte(c)
+			b.WriteByte(text[i+1])
+			i++
+			continue
+		case c == '"' || c == '\'':
+			if quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// quoteValue escapes a value the way parseCommandLine reads it back. Inside
+// quotes everything is taken as is but the closing quote, outside of them
+// blanks, quotes and backslashes are escaped
+func quoteValue(value string, quote byte, first bool) (string, error) {
+	if quote != 0 {
+		if strings.IndexByte(value, quote) != -1 {
+			return "", fmt.Errorf("the value has a %c, use it outside quotes", quote)
+		}
+		return value, nil
+	}
+	if value == "" && !first {
+		return "''", nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if strings.IndexByte(" \t\"'\\", c) != -1 && !(first && i == 0) {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+func variableValue(name string, path []string, aliases map[string]*alias) (string, error) {
+	if name == "last" {
+		lastOutputMu.Lock()
+		out := lastOutput
+		lastOutputMu.Unlock()
+		if out == "" {
+			return "", fmt.Errorf("no command has run yet")
+		}
+		switch {
+		case len(path) == 0:
+			return strings.TrimSpace(out), nil
+		case path[0] == "json":
+			return jsonPath(out, path[1:])
+		case len(path) == 1:
+			return jsonFind(out, path[0])
+		}
+		return "", fmt.Errorf("use $last.json.%s for a path", strings.Join(path, "."))
+	}
+
+	a, ok := aliases[name]
+	if !ok {
+		return "", fmt.Errorf("unknown node %s", name)
+	}
+	if a.Port == 0 {
+		return "", fmt.Errorf("%s is not an lnd node", name)
+	}
+	if len(path) != 1 {
+		return "", fmt.Errorf("expected one of %s", strings.Join(variableFields, ", "))
+	}
+	switch path[0] {
+	case "pubkey":
+		info := nodeInfo(a)
+		if info == nil {
+			return "", fmt.Errorf("cannot connect to %s", name)
+		}
+		return info.IdentityPubkey, nil
+	case "host":
+		return fmt.Sprintf("127.0.0.1:%d", a.Port+1000), nil
+	case "rpc":
+		return fmt.Sprintf("localhost:%d", a.Port), nil
+	}
+	return "", fmt.Errorf("unknown field %s, expected one of %s", path[0], strings.Join(variableFields, ", "))
+}
+
+// parseOutput decodes a command's JSON output keeping numbers as written,
+// chan_ids do not fit a float64
+func parseOutput(out string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(out))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("last output is not json")
+	}
+	return v, nil
+}
+
+// jsonPath follows object keys and array indexes from the top of the output
+func jsonPath(out string, path []string) (string, error) {
+	v, err := parseOutput(out)
+	if err != nil {
+		return "", err
+	}
+	for i, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("no field %s", strings.Join(path[:i+1], "."))
+			}
+			v = next
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(node) {
+				return "", fmt.Errorf("no index %s", strings.Join(path[:i+1], "."))
+			}
+			v = node[n]
+		default:
+			return "", fmt.Errorf("%s is not an object or array", strings.Join(path[:i], "."))
+		}
+	}
+	return jsonString(v)
+}
+
+// jsonFind returns the first field with the key anywhere in the output
+func jsonFind(out string, key string) (string, error) {
+	v, err := parseOutput(out)
+	if err != nil {
+		return "", err
+	}
+	if found, ok := findKey(v, key); ok {
+		return jsonString(found)
+	}
+	return "", fmt.Errorf("no field %s in last output", key)
+}
+
+func findKey(v interface{}, key string) (interface{}, bool) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if found, ok := node[key]; ok {
+			return found, true
+		}
+		for _, k := range sortedKeys(node) {
+			if found, ok := findKey(node[k], key); ok {
+				return found, true
+			}
+		}
+	case []interface{}:
+		for _, item := range node {
+			if found, ok := findKey(item, key); ok {
+				return found, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonString is a string as is and anything else as compact json
+func jsonString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testOutput = `{
+	"channels": [
+		{"chan_id": "123456789012345678901", "remote_pubkey": "02aa", "active": true},
+		{"chan_id": "2", "remote_pubkey": "03bb", "pending_htlcs": [{"amount": "10000"}]}
+	],
+	"memo": "pay \"me\" <now>",
+	"total": 2
+}`
+
+func TestJsonPath(t *testing.T) {
+	tests := []struct {
+		path []string
+		want string
+		err  bool
+	}{
+		{[]string{"total"}, "2", false},
+		{[]string{"channels", "0", "chan_id"}, "123456789012345678901", false},
+		{[]string{"channels", "1", "pending_htlcs", "0"}, `{"amount":"10000"}`, false},
+		{[]string{"channels", "0", "active"}, "true", false},
+		{[]string{"memo"}, `pay "me" <now>`, false},
+		{[]string{"channels", "2"}, "", true},
+		{[]string{"channels", "x"}, "", true},
+		{[]string{"nope"}, "", true},
+		{[]string{"total", "x"}, "", true},
+	}
+	for _, test := range tests {
+		got, err := jsonPath(testOutput, test.path)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("jsonPath(%v) = %q, %v, want %q, error %v", test.path, got, err, test.want, test.err)
+		}
+	}
+	if _, err := jsonPath("not json", []string{"a"}); err == nil {
+		t.Errorf("jsonPath on plain text should fail")
+	}
+}
+
+func TestJsonFind(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+		err  bool
+	}{
+		{"remote_pubkey", "02aa", false},
+		{"amount", "10000", false},
+		{"total", "2", false},
+		{"nope", "", true},
+	}
+	for _, test := range tests {
+		got, err := jsonFind(testOutput, test.key)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("jsonFind(%s) = %q, %v, want %q, error %v", test.key, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	name := "Smith"
+	backend := "bitcoind1"
+	aliases := map[string]*alias{
+		name:    {Name: &name, Port: 10001},
+		backend: {Name: &backend},
+	}
+	setLastOutput(testOutput)
+	defer setLastOutput("")
+
+	tests := []struct {
+		text string
+		want []string
+		err  bool
+	}{
+		{"connect $Smith.host", []string{"connect", "127.0.0.1:11001"}, false},
+		{"getinfo --rpcserver=$Smith.rpc", []string{"getinfo", "--rpcserver=localhost:10001"}, false},
+		{"lookup $last.json.channels.1.chan_id", []string{"lookup", "2"}, false},
+		{"addinvoice --memo=$last.memo 10", []string{"addinvoice", `--memo=pay "me" <now>`, "10"}, false},
+		{"echo $last.channels", []string{"echo", `[{"active":true,"chan_id":"123456789012345678901","remote_pubkey":"02aa"},{"chan_id":"2","pending_htlcs":[{"amount":"10000"}],"remote_pubkey":"03bb"}]`}, false},
+		{"echo 'a $last.total b'", []string{"echo", "a 2 b"}, false},
+		{"echo '$last.memo'", []string{"echo", `pay "me" <now>`}, false},
+		{"echo \"$last.memo\"", nil, true},
+		{"echo $$Smith \\$last", []string{"echo", "$Smith", "$last"}, false},
+		{"echo 5$ $", []string{"echo", "5$", "$"}, false},
+		{"echo $Jones.host", nil, true},
+		{"echo $bitcoind1.host", nil, true},
+		{"echo $Smith.macaroon", nil, true},
+		{"echo $last.nope", nil, true},
+	}
+	for _, test := range tests {
+		expanded, err := interpolate(test.text, aliases)
+		if (err != nil) != test.err {
+			t.Errorf("interpolate(%s) error %v, want error %v", test.text, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		args, err := parseCommandLine(expanded)
+		if err != nil || !reflect.DeepEqual(args, test.want) {
+			t.Errorf("interpolate(%s) = %s, parsed %q, %v, want %q", test.text, expanded, args, err, test.want)
+		}
+	}
+
+	setLastOutput("")
+	if _, err := interpolate("echo $last", aliases); err == nil {
+		t.Errorf("$last with no output should fail")
+	}
+}
@@ -5,36 +5,69 @@ import (
 	"fmt"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"math/rand"
+	"net"
 	"os/exec"
 	"sort"
+	"sync"
 	"time"
 )
 
+// connections are the peers each node connected to, churn adds to them while
+// the graph reads them. peerinfo is the getinfo of the nodes connected to at
+// launch, read by the cli while the launch runs, both are behind
+// connectionsMu
 var connections map[string][]string
+var connectionsMu sync.Mutex
 var peerinfo map[string]*lnrpc.GetInfoResponse
 
 type Launcher struct {
 	aliases   map[string]*alias
 	nChannels int
+	funding   *Funding
+	perNode   map[int]*Funding
+	unfunded  map[string]bool
+	chanType  string
 }
 
-func NewLauncher(aliases map[string]*alias, chans int) *Launcher {
+// NewLauncher funds every node the same way except the last nUnfunded nodes
+// by alias which get nothing and only receive channels, and the nodes with
+// their own funding by number in perNode, which are funded even if they are
+// among the last
+func NewLauncher(aliases map[string]*alias, chans int, funding *Funding, perNode map[int]*Funding, nUnfunded int, chanType string) *Launcher {
+	unfunded := make(map[string]bool)
+	keys := sortAliasKeys(aliases)
+	for i := len(keys) - 1; i >= 0 && i >= len(keys)-nUnfunded; i-- {
+		if _, ok := perNode[aliases[keys[i]].index()]; !ok {
+			unfunded[keys[i]] = true
+		}
+	}
 	return &Launcher{
 		aliases:   aliases,
 		nChannels: chans,
+		funding:   funding,
+		perNode:   perNode,
+		unfunded:  unfunded,
+		chanType:  chanType,
 	}
 }
 
 func (l *Launcher) createWallets() {
 	for _, v := range l.aliases {
 		logger.log("creating wallet: " + *v.Name)
-		ln := unlocker(v)
+		ln, conn := waitUnlocker(v)
+		if ln == nil {
+			logger.logerr("Cannot reach unlocker", *v.Name)
+			return
+		}
 
 		ctx := context.Background()
 		seed, err := ln.GenSeed(ctx, &lnrpc.GenSeedRequest{})
-		_, err = ln.InitWallet(ctx, &lnrpc.InitWalletRequest{
-			WalletPassword:     []byte("password"),
-			CipherSeedMnemonic: seed.CipherSeedMnemonic})
+		if err == nil {
+			_, err = ln.InitWallet(ctx, &lnrpc.InitWalletRequest{
+				WalletPassword:     []byte("password"),
+				CipherSeedMnemonic: seed.CipherSeedMnemonic})
+		}
+		conn.Close()
 		if err != nil {
 			logger.logerr("Cannot get info from node", err.Error())
 			return
@@ -59,19 +92,134 @@ func (l *Launcher) launchLnd() {
 	}
 }
 
+// stopLnd shuts a node down with lncli stop and waits for its rpc port to close
+func stopLnd(a *alias) error {
+	out, err := a.Command("stop").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), out)
+	}
+	host := fmt.Sprintf("localhost:%d", a.Port)
+	for i := 0; i < 30; i++ {
+		conn, err := net.DialTimeout("tcp", host, time.Second)
+		if err != nil {
+			return nil
+		}
+		conn.Close()
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s did not shut down", *a.Name)
+}
+
+// lnd features only some nodes need, switched on when a scenario asks for
+// them and kept so a rewritten lnd.conf still has them
+const FEATURE_WATCHTOWER = "watchtower"
+const FEATURE_WTCLIENT = "wtclient"
+const FEATURE_SCID_ALIAS = "scid-alias"
+const FEATURE_ZERO_CONF = "zero-conf"
+
+var features = make(map[string]map[string]bool)
+var featuresMu sync.Mutex
+
+func hasFeature(name, feature string) bool {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	return features[name][feature]
+}
+
+// addFeature records the feature for the node's next lnd.conf, it reports
+// whether the node did not have it yet
+func addFeature(name, feature string) bool {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	if features[name][feature] {
+		return false
+	}
+	if features[name] == nil {
+		features[name] = make(map[string]bool)
+	}
+	features[name][feature] = true
+	return true
+}
+
+// enableFeature switches the features on in the node's lnd.conf and restarts
+// it, it reports whether the node had to be restarted
+func enableFeature(a *alias, feature ...string) (bool, error) {
+	added := false
+	for _, f := range feature {
+		if addFeature(*a.Name, f) {
+			added = true
+		}
+	}
+	if !added {
+		return false, nil
+	}
+
+	if err := writeLndConf(nodeView(a.index(), *a.Name)); err != nil {
+		return false, err
+	}
+	if err := stopLnd(a); err != nil {
+		return false, err
+	}
+	return true, startLnd(a)
+}
+
+// startLnd relaunches a stopped node from its config and unlocks its wallet
+func startLnd(a *alias) error {
+	cmd := exec.Command("lnd", fmt.Sprintf("--configfile=%s/.lndev/user%d/lnd.conf", userdir, a.index()))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	ln, conn := waitUnlocker(a)
+	if ln == nil {
+		return fmt.Errorf("cannot reach unlocker for %s", *a.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), UNLOCK_TIMEOUT)
+	_, err := ln.UnlockWallet(ctx, &lnrpc.UnlockWalletRequest{
+		WalletPassword: []byte("password"),
+	})
+	cancel()
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	// a cached connection may be backing off from the outage, start fresh and
+	// wait for the server to come up after the unlock
+	dropConn(a)
+	for i := 0; i < 60; i++ {
+		if rpc := grpcClient(a); rpc != nil {
+			if _, err = rpc.GetInfo(context.Background(), &lnrpc.GetInfoRequest{}); err == nil {
+				return nil
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s did not start: %s", *a.Name, err)
+}
+
 func (l *Launcher) openChannels() {
 	for _, a := range l.aliases {
-		rpc := grpcClient(a)
-		ctx := context.Background()
-		for _, c := range connections[*a.Name] {
+		for _, c := range connectedTo(*a.Name) {
+			src, dest := a, l.aliases[c]
+			if l.unfunded[*src.Name] {
+				// receive only nodes get their channels opened to them
+				src, dest = dest, src
+			}
+			if l.unfunded[*src.Name] {
+				logger.log(fmt.Sprintf("skipping channel: %s and %s are both unfunded", *a.Name, c))
+				continue
+			}
 
-			logger.log(fmt.Sprintf("opening channel: %s -> %s", *a.Name, c))
+			opts, err := NewChannelOptions(l.chanType)
+			if err != nil {
+				logger.logerr("channel type", err.Error())
+				return
+			}
+			logger.log(fmt.Sprintf("opening %s channel: %s -> %s", opts, *src.Name, *dest.Name))
 
-			peer := peerinfo[c]
-			_, err := rpc.OpenChannelSync(ctx, &lnrpc.OpenChannelRequest{
-				NodePubkeyString:   peer.GetIdentityPubkey(),
-				LocalFundingAmount: int64(rand.Intn(50000) + 100000),
-			})
+			_, err = openChannel(src, dest, int64(rand.Intn(CHANNEL_RANGE)+CHANNEL_MIN), opts)
 			if err != nil {
 				logger.log(fmt.Sprintf("Cannot fund with peer %s\n\n", err))
 				continue
@@ -85,21 +233,18 @@ func (l *Launcher) openChannels() {
 
 func (l *Launcher) fundNodes() {
 	for _, a := range l.aliases {
-		rpc := grpcClient(a)
-		ctx := context.Background()
-
-		addr, err := rpc.NewAddress(ctx, &lnrpc.NewAddressRequest{
-			Type: lnrpc.AddressType_NESTED_PUBKEY_HASH,
-		})
-		if err != nil {
-			logger.logerr("fund node address failure", err.Error())
+		if l.unfunded[*a.Name] {
+			logger.log(fmt.Sprintf("leaving %s unfunded", *a.Name))
 			continue
 		}
-		cmd := exec.Command("bitcoin-cli", fmt.Sprintf("-conf=%s/.lndev/bitcoin/bitcoin.conf", userdir), "sendtoaddress", addr.Address, "1")
-		err = cmd.Run()
-
+		f := l.funding
+		if nf, ok := l.perNode[a.index()]; ok {
+			f = nf
+			logger.log(fmt.Sprintf("funding %s with %.8f BTC in %d %s utxos", *a.Name, f.BTC, f.UTXOs, f.AddrType))
+		}
+		err := fund(a, f)
 		if err != nil {
-			logger.logerr("fund node send failure", err.Error())
+			logger.logerr("fund node failure", err.Error())
 		}
 	}
 	l.generate(10)
@@ -109,12 +254,14 @@ func (l *Launcher) fundNodes() {
 func (l *Launcher) connectPeers() {
 	aliaskeys := make([]string, 0, len(l.aliases))
 
+	connectionsMu.Lock()
 	connections = make(map[string][]string)
 	peerinfo = make(map[string]*lnrpc.GetInfoResponse)
 	for key := range l.aliases {
 		aliaskeys = append(aliaskeys, key)
 		connections[key] = []string{}
 	}
+	connectionsMu.Unlock()
 
 	rand.Seed(time.Now().UnixNano())
 
@@ -128,7 +275,8 @@ func (l *Launcher) connectPeers() {
 			index := rand.Intn(len(aliaskeys))
 			for {
 				dest = l.aliases[aliaskeys[(index+i)%len(aliaskeys)]]
-				if dest.Name != src.Name && sort.SearchStrings(connections[*src.Name], *dest.Name) == len(connections[*src.Name]) && sort.SearchStrings(connections[*dest.Name], *src.Name) == len(connections[*dest.Name]) {
+				srcconns, destconns := connectedTo(*src.Name), connectedTo(*dest.Name)
+				if dest.Name != src.Name && sort.SearchStrings(srcconns, *dest.Name) == len(srcconns) && sort.SearchStrings(destconns, *src.Name) == len(destconns) {
 					break
 				}
 				i++
@@ -160,8 +308,8 @@ func (l *Launcher) connectPeers() {
 				logger.logerr("source connect failure", err.Error())
 				return
 			}
-			connections[*src.Name] = append(connections[*src.Name], *dest.Name)
-			peerinfo[*dest.Name] = destInfoResp
+			addConnection(*src.Name, *dest.Name)
+			setPeerInfo(*dest.Name, destInfoResp)
 			logger.log(fmt.Sprintf("[green]connected:[white] %s -> %s", *src.Name, *dest.Name))
 			l.generate(1) // force chain sync?
 			time.Sleep(1200 * time.Millisecond)
@@ -171,17 +319,20 @@ func (l *Launcher) connectPeers() {
 }
 
 func (l *Launcher) launchNodes() {
-	logger.log("launching bitcoin node")
-
-	cmd := exec.Command("bitcoind", fmt.Sprintf("-conf=%s//.lndev/bitcoin/bitcoin.conf", userdir))
-
-	err := cmd.Start()
-
-	if err != nil {
-		logger.logerr("bitcoin start fail", err.Error())
+	for _, b := range backends {
+		logger.log("launching bitcoin node " + b.String())
+		if err := b.start(); err != nil {
+			logger.logerr("bitcoin start fail", err.Error())
+		}
+	}
+	checkBitcoind()
+	if err := setupWallet(); err != nil {
+		logger.logerr("bitcoin wallet setup fail", err.Error())
 	}
-	time.Sleep(2 * time.Second)
 	l.generate(120)
+	if err := waitSynced(30 * time.Second); err != nil {
+		logger.logerr("bitcoin backends not synced", err.Error())
+	}
 	time.Sleep(1 * time.Second)
 
 	logger.log("launching lnd nodes")
@@ -203,16 +354,85 @@ func (l *Launcher) launchNodes() {
 
 }
 
-func (l *Launcher) generate(n int) {
-	out, err := exec.Command("bitcoin-cli", fmt.Sprintf("-conf=%s//.lndev/bitcoin/bitcoin.conf", userdir), "getnewaddress").Output()
+func (l *Launcher) generate(n int) []string {
+	addr, err := btc.GetNewAddress()
 	if err != nil {
 		logger.logerr("get new address fail", err.Error())
+		return nil
 	}
 
-	cmd := exec.Command("bitcoin-cli", fmt.Sprintf("-conf=%s//.lndev/bitcoin/bitcoin.conf", userdir), "generatetoaddress", fmt.Sprintf("%d", n), string(out))
-	err = cmd.Run()
+	hashes, err := btc.GenerateToAddress(n, addr)
+	if err != nil {
+		logger.logerr("generate block failure", err.Error())
+	}
+	return hashes
+}
+
+func addConnection(src, dest string) {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	connections[src] = append(connections[src], dest)
+}
+
+func setPeerInfo(name string, info *lnrpc.GetInfoResponse) {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	peerinfo[name] = info
+}
+
+// peerInfo is the node's getinfo from the launch, if it was connected to
+func peerInfo(name string) (*lnrpc.GetInfoResponse, bool) {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	info, ok := peerinfo[name]
+	return info, ok
+}
 
+// pubkeys caches the identity pubkey of each node once it is known, a node
+// keeps its key across restarts
+var pubkeys = make(map[string]string)
+var pubkeysMu sync.Mutex
+
+// PUBKEY_TIMEOUT bounds asking a node for its pubkey, a node that is down
+// is asked again next time
+const PUBKEY_TIMEOUT = 2 * time.Second
+
+// cachedPubkey is the node's pubkey if it came with the launch or was asked
+// before
+func cachedPubkey(a *alias) (string, bool) {
+	if info, ok := peerInfo(*a.Name); ok {
+		return info.IdentityPubkey, true
+	}
+	pubkeysMu.Lock()
+	defer pubkeysMu.Unlock()
+	pubkey, ok := pubkeys[*a.Name]
+	return pubkey, ok
+}
+
+// nodePubkey is the node's identity pubkey, asked once if not cached
+func nodePubkey(a *alias) string {
+	if pubkey, ok := cachedPubkey(a); ok {
+		return pubkey
+	}
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PUBKEY_TIMEOUT)
+	defer cancel()
+	info, err := rpc.GetInfo(ctx, &lnrpc.GetInfoRequest{})
 	if err != nil {
-		logger.logerr("generat block failure", err.Error())
+		return ""
 	}
+	pubkeysMu.Lock()
+	pubkeys[*a.Name] = info.IdentityPubkey
+	pubkeysMu.Unlock()
+	return info.IdentityPubkey
+}
+
+// connectedTo is a copy of the node's connections
+func connectedTo(name string) []string {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	return append([]string{}, connections[name]...)
 }
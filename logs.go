@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gdamore/tcell"
+	"github.com/rivo/tview"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logs tails the selected node's lnd log, or the debug.log of its bitcoind,
+// filtered by subsystem and level. The files are read as they grow, with
+// follow paused the view stays put so it can be scrolled
+type Logs struct {
+	*tview.Flex
+	input    *tview.InputField
+	view     *tview.TextView
+	lines    []logLine
+	path     string
+	name     string
+	offset   int64
+	level    int
+	bitcoind bool
+	paused   bool
+	filter   string
+	visible  bool
+	stop     chan bool
+	wake     chan bool
+	mu       sync.Mutex
+}
+
+type logLine struct {
+	text  string
+	level int
+	sub   string
+}
+
+var logs *Logs
+
+const LOG_POLL = time.Second
+const LOG_LINES = 2000
+
+// LOG_TAIL is how much of an existing log is read when it is first shown
+const LOG_TAIL = 256 * 1024
+
+// lnd levels from least to most severe, lines of bitcoind have no level
+var logLevels = []string{"TRC", "DBG", "INF", "WRN", "ERR", "CRT"}
+
+// lncli debuglevel names of logLevels
+var debugLevels = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+var lndLogLine = regexp.MustCompile(`^\S+ \S+ \[(\w{3})\] (\w+):`)
+
+func NewLogs() *Logs {
+	l := &Logs{
+		Flex:  tview.NewFlex().SetDirection(tview.FlexRow),
+		input: tview.NewInputField().SetLabel("Subsystems: ").SetPlaceholder("all, or HSWC,PEER,...").SetFieldBackgroundColor(tcell.ColorBlack),
+		view:  tview.NewTextView().SetDynamicColors(true),
+		level: 1,
+		wake:  make(chan bool, 1),
+	}
+	l.view.SetBorder(true)
+	l.AddItem(l.input, 1, 0, true)
+	l.AddItem(l.view, 0, 1, false)
+
+	l.input.SetChangedFunc(func(text string) {
+		l.mu.Lock()
+		l.filter = text
+		l.mu.Unlock()
+		go l.render()
+	})
+	l.input.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		switch key.Key() {
+		case tcell.KeyF2:
+			l.mu.Lock()
+			l.level = (l.level + 1) % len(logLevels)
+			l.mu.Unlock()
+			go l.render()
+		case tcell.KeyF3:
+			l.mu.Lock()
+			l.paused = !l.paused
+			l.mu.Unlock()
+			go l.render()
+		case tcell.KeyF4:
+			l.mu.Lock()
+			l.bitcoind = !l.bitcoind
+			l.mu.Unlock()
+			// only the poller refreshes, so the log is never read twice
+			select {
+			case l.wake <- true:
+			default:
+			}
+		case tcell.KeyF5:
+			l.mu.Lock()
+			level := l.level
+			l.mu.Unlock()
+			go setDebugLevel(ui.currentnode, l.input.GetText(), level)
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn, tcell.KeyHome, tcell.KeyEnd:
+			// scrolling is only seen while paused, following jumps to the end
+			l.view.InputHandler()(key, func(tview.Primitive) {})
+		case tcell.KeyEscape:
+			ui.togglePane("logs", l)
+		default:
+			return key
+		}
+		return nil
+	})
+	return l
+}
+
+func (l *Logs) Show() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.visible {
+		return
+	}
+	l.visible = true
+	l.stop = make(chan bool)
+	stop := l.stop
+	go (func() {
+		for {
+			l.refresh(ui.selectedNode())
+			select {
+			case <-stop:
+				return
+			case <-l.wake:
+			case <-time.After(LOG_POLL):
+			}
+		}
+	})()
+}
+
+func (l *Logs) Hide() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.visible {
+		return
+	}
+	l.visible = false
+	close(l.stop)
+}
+
+// logPath is the log shown for a node, a bitcoind node always shows its
+// debug.log
+func (l *Logs) logPath(node string) (string, string) {
+	for _, b := range backends {
+		if b.String() == node {
+			return fmt.Sprintf("%s/regtest/debug.log", b.Datadir), b.String()
+		}
+	}
+	a, ok := ui.aliases[node]
+	if !ok {
+		return "", ""
+	}
+	if l.bitcoind {
+		b := backendFor(a.index(), *a.Name)
+		return fmt.Sprintf("%s/regtest/debug.log", b.Datadir), fmt.Sprintf("%s of %s", b, *a.Name)
+	}
+	return fmt.Sprintf("%s/.lndev/user%d/log/bitcoin/regtest/lnd.log", userdir, a.index()), *a.Name
+}
+
+// refresh reads what was added to the node's log since the last time,
+// starting over when the node changed or the log was rotated
+func (l *Logs) refresh(node string) {
+	l.mu.Lock()
+	path, name := l.logPath(node)
+	if path != l.path {
+		l.path = path
+		l.name = name
+		l.offset = -1
+		l.lines = nil
+	}
+	offset := l.offset
+	l.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		app.QueueUpdateDraw(func() {
+			l.view.SetText(fmt.Sprintf("no log for %s yet", node))
+		})
+		l.render()
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	skip := false
+	switch {
+	case offset < 0 && info.Size() > LOG_TAIL:
+		// the first line is likely cut
+		offset = info.Size() - LOG_TAIL
+		skip = true
+	case offset < 0 || info.Size() < offset:
+		offset = 0
+	case info.Size() == offset:
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+	// only whole lines, the rest is read next time
+	end := strings.LastIndex(string(data), "\n") + 1
+	text := string(data[:end])
+	if skip {
+		text = text[strings.Index(text, "\n")+1:]
+	}
+
+	l.mu.Lock()
+	if l.path == path {
+		l.offset = offset + int64(end)
+		l.add(text)
+	}
+	l.mu.Unlock()
+	l.render()
+}
+
+// add parses the lines, a line without lnd's prefix continues the one
+// before it and takes its level and subsystem
+func (l *Logs) add(text string) {
+	for _, s := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		line := logLine{text: s, level: -1}
+		if m := lndLogLine.FindStringSubmatch(s); m != nil {
+			line.sub = m[2]
+			for i, lvl := range logLevels {
+				if lvl == m[1] {
+					line.level = i
+				}
+			}
+		} else if n := len(l.lines); n > 0 && s != "" && !strings.HasPrefix(s, "20") {
+			line.level = l.lines[n-1].level
+			line.sub = l.lines[n-1].sub
+		}
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > LOG_LINES {
+		l.lines = l.lines[len(l.lines)-LOG_LINES:]
+	}
+}
+
+// subsystems typed in the filter, none means all
+func subsystems(filter string) map[string]bool {
+	subs := make(map[string]bool)
+	for _, s := range strings.Split(filter, ",") {
+		if s = strings.ToUpper(strings.TrimSpace(s)); s != "" {
+			subs[s] = true
+		}
+	}
+	return subs
+}
+
+func (l *Logs) render() {
+	l.mu.Lock()
+	title := fmt.Sprintf("%s %s", l.name, l.status())
+	if l.paused || l.lines == nil {
+		l.mu.Unlock()
+		app.QueueUpdateDraw(func() {
+			l.view.SetTitle(title)
+		})
+		return
+	}
+	subs := subsystems(l.filter)
+	var b strings.Builder
+	for _, line := range l.lines {
+		if line.level >= 0 && line.level < l.level {
+			continue
+		}
+		if len(subs) > 0 {
+			// bitcoind lines have no subsystem, match them by text
+			if line.sub == "" && !subsMatch(line.text, subs) || line.sub != "" && !subs[line.sub] {
+				continue
+			}
+		}
+		color := "white"
+		switch {
+		case line.level >= 4:
+			color = "red"
+		case line.level == 3:
+			color = "yellow"
+		case line.level >= 0 && line.level <= 1:
+			color = "gray"
+		}
+		fmt.Fprintf(&b, "[%s]%s[white]\n", color, tview.Escape(line.text))
+	}
+	l.mu.Unlock()
+	app.QueueUpdateDraw(func() {
+		l.view.SetTitle(title)
+		l.view.SetText(b.String())
+		l.view.ScrollToEnd()
+	})
+}
+
+func subsMatch(text string, subs map[string]bool) bool {
+	upper := strings.ToUpper(text)
+	for s := range subs {
+		if strings.Contains(upper, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Logs) status() string {
+	follow := "following"
+	if l.paused {
+		follow = "paused"
+	}
+	source := "F4 bitcoind"
+	if l.bitcoind {
+		source = "F4 lnd"
+	}
+	return fmt.Sprintf("(%s and up, %s, F2 level, F3 follow, %s, F5 set lnd to level, Esc to close)", logLevels[l.level], follow, source)
+}
+
+// setDebugLevel sets the node's lnd to the shown level with lncli
+// debuglevel, for the subsystems in the filter or the whole node
+func setDebugLevel(node, filter string, level int) {
+	a, ok := ui.aliases[node]
+	if !ok || a.Port == 0 {
+		return
+	}
+	spec := debugLevels[level]
+	if subs := subsystems(filter); len(subs) > 0 {
+		parts := []string{}
+		for s := range subs {
+			parts = append(parts, s+"="+debugLevels[level])
+		}
+		sort.Strings(parts)
+		spec = strings.Join(parts, ",")
+	}
+	out, err := a.Command("debuglevel", "--level="+spec).CombinedOutput()
+	if err != nil {
+		ui.setStatus("debuglevel", fmt.Sprintf("%s debuglevel %s failed: %s", *a.Name, spec, strings.TrimSpace(string(out))))
+		return
+	}
+	ui.setStatus("debuglevel", fmt.Sprintf("%s debuglevel %s", *a.Name, spec))
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/atotto/clipboard"
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
+	"os"
 	"strconv"
 	"time"
 )
@@ -15,9 +16,14 @@ var flex *tview.Flex
 var form *tview.Form
 var app *tview.Application
 var ui *MainUI
-var nNodes, nChannels, nPayments string
+var nNodes, nChannels, nPayments, nRebalance, recordPath string
+var fundBTC, fundUTXOs, fundType, nodeFunding, nUnfunded, nBackends, chanType string
 var act *Activity
 
+// shutdownErr is shown once the terminal is restored on quit
+var shutdownErr error
+var rebalancer *Rebalancer
+
 func main() {
 
 	app = tview.NewApplication()
@@ -32,6 +38,33 @@ func main() {
 		AddInputField("Number of Random Payments", "", 5, tview.InputFieldInteger, func(t string) {
 			nPayments = t
 		}).
+		AddInputField("Rebalance Threshold (%)", "", 5, tview.InputFieldInteger, func(t string) {
+			nRebalance = t
+		}).
+		AddInputField("Record Payments To", "", 30, nil, func(t string) {
+			recordPath = t
+		}).
+		AddInputField("BTC per Node", "1", 10, tview.InputFieldFloat, func(t string) {
+			fundBTC = t
+		}).
+		AddInputField("UTXOs per Node", "1", 5, tview.InputFieldInteger, func(t string) {
+			fundUTXOs = t
+		}).
+		AddDropDown("Address Type", addressTypes, 0, func(option string, index int) {
+			fundType = option
+		}).
+		AddInputField("Per Node Funding", "", 30, nil, func(t string) {
+			nodeFunding = t
+		}).
+		AddInputField("Unfunded Nodes", "", 5, tview.InputFieldInteger, func(t string) {
+			nUnfunded = t
+		}).
+		AddInputField("Bitcoin Backends", "1", 5, tview.InputFieldInteger, func(t string) {
+			nBackends = t
+		}).
+		AddDropDown("Channel Type", channelTypes, 0, func(option string, index int) {
+			chanType = option
+		}).
 		AddButton("Ok", setUI).
 		AddButton("Cancel", func() {
 			app.Stop()
@@ -44,6 +77,10 @@ func main() {
 	if err := app.SetRoot(flex, true).Run(); err != nil {
 		panic(err)
 	}
+	if shutdownErr != nil {
+		fmt.Fprintln(os.Stderr, shutdownErr)
+		os.Exit(1)
+	}
 }
 
 func swapForm() {
@@ -51,7 +88,8 @@ func swapForm() {
 	col.AddItem(ui.list, 40, 1, false)
 	col.AddItem(ui.cli, 0, 1, true)
 	flex.AddItem(col, 3, 1, true)
-	flex.AddItem(ui.cliresult, 0, 5, false)
+	flex.AddItem(ui.body, 0, 5, false)
+	flex.AddItem(ui.status, 1, 0, false)
 	flex.RemoveItem(form)
 }
 
@@ -60,21 +98,51 @@ func setUI() {
 	ui = NewMainUI()
 
 	ui.populateList(names.Results)
+	completer = NewCompleter(ui.aliases)
+	search = NewSearch()
 
 	app.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
 		if key.Key() == tcell.KeyCtrlN {
 			app.SetFocus(ui.list)
 			ui.list.InputHandler()(tcell.NewEventKey(tcell.KeyEnter, '0', tcell.ModNone), func(tview.Primitive) { app.SetFocus(ui.list) })
 		} else if key.Key() == tcell.KeyCtrlI {
+			// tab is ctrl+i, on the cli it completes instead
+			if app.GetFocus() == ui.cli {
+				return key
+			}
 			ui.cli.SetText("")
 			app.SetFocus(ui.cli)
 		} else if key.Key() == tcell.KeyCtrlA {
-			err := clipboard.WriteAll(ui.nodes[ui.currentnode].Buff)
+			err := clipboard.WriteAll(plainText(ui.nodes[ui.currentnode].Buff))
 			if err != nil {
 				fmt.Fprintf(ui.cliresult, "%s\n", err.Error())
 			}
 		} else if key.Key() == tcell.KeyCtrlO {
-			app.SetFocus(ui.cliresult)
+			app.SetFocus(ui.body)
+		} else if key.Key() == tcell.KeyCtrlP {
+			go act.TogglePause()
+		} else if key.Key() == tcell.KeyCtrlB {
+			if miner != nil {
+				go miner.Toggle()
+			}
+		} else if key.Key() == tcell.KeyCtrlE {
+			if explorer != nil {
+				ui.togglePane("explorer", explorer)
+			}
+		} else if key.Key() == tcell.KeyCtrlD {
+			if dashboard != nil {
+				ui.togglePane("dashboard", dashboard)
+			}
+		} else if key.Key() == tcell.KeyCtrlG {
+			if graph != nil {
+				ui.togglePane("graph", graph)
+			}
+		} else if key.Key() == tcell.KeyCtrlF {
+			ui.togglePane("search", search)
+		} else if key.Key() == tcell.KeyCtrlT {
+			if logs != nil {
+				ui.togglePane("logs", logs)
+			}
 		}
 		return key
 	})
@@ -85,13 +153,19 @@ func setUI() {
 	logger = NewLogger(status, done)
 	lndaliases := make(map[string]*alias)
 	for _, v := range ui.aliases {
-		if *v.Name == "Regtest" {
+		if v.Port == 0 {
 			continue
 		}
 		lndaliases[*v.Name] = v
 	}
 
-	launcher := NewLauncher(lndaliases, n)
+	unfunded, _ := strconv.Atoi(nUnfunded)
+	funding := NewFunding(fundBTC, fundUTXOs, fundType)
+	perNode, err := parseNodeFunding(nodeFunding, funding)
+	if err != nil {
+		fmt.Fprintf(ui.cliresult, "[red]per node funding ignored: [white]%s\n", tview.Escape(err.Error()))
+	}
+	launcher := NewLauncher(lndaliases, n, funding, perNode, unfunded, chanType)
 	go launcher.launchNodes()
 	swapForm()
 	next := make(chan int)
@@ -102,18 +176,51 @@ func setUI() {
 				fmt.Fprintln(ui.cliresult, s)
 				app.Draw()
 			case <-done:
-				next <- 0
-				return
+				// status messages still come after the launch, a nil
+				// channel is never ready so next is closed only once
+				close(next)
+				done = nil
 			}
 		}
 	})()
 
+	go (func() {
+		<-next
+		chaos = NewChaos(lndaliases)
+		churn = NewChurn(lndaliases, launcher)
+		miner = NewMiner(launcher)
+		feemarket = NewFeeMarket()
+		scenarios = NewScenarios(lndaliases, launcher)
+		explorer = NewExplorer(lndaliases)
+		dashboard = NewDashboard(lndaliases, ui.cliresult)
+		graph = NewGraph(lndaliases)
+		logs = NewLogs()
+		miner.WatchHeight()
+	})()
+
 	npays, _ := strconv.Atoi(nPayments)
 	act = NewActivity(npays, lndaliases)
+	if recordPath != "" {
+		if err := act.Record(recordPath); err != nil {
+			fmt.Fprintf(ui.cliresult, "[red]cannot record payments: [white]%s\n", err.Error())
+		}
+	}
 	go (func() {
 		<-next
 		time.Sleep(3 * time.Second)
 		act.Run()
 	})()
 
+	threshold, _ := strconv.Atoi(nRebalance)
+	go (func() {
+		<-next
+		if threshold > 50 && threshold < 100 {
+			rebalancer = NewRebalancer(threshold, lndaliases)
+			rebalancer.Start()
+		} else {
+			// :rebalance can start it later
+			rebalancer = NewRebalancer(REBALANCE_THRESHOLD, lndaliases)
+		}
+	})()
+
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Miner mines blocks in the background so transactions made from the cli
+// confirm without typing generatetoaddress in the Regtest pane
+type Miner struct {
+	agent
+	launcher *Launcher
+	mode     string
+	every    time.Duration
+	mined    int
+	height   int
+}
+
+const MINER_EVERY = 10 * time.Second
+const HEIGHT_POLL = 3 * time.Second
+
+var miner *Miner
+
+func NewMiner(launcher *Launcher) *Miner {
+	return &Miner{
+		launcher: launcher,
+		mode:     "fixed",
+		every:    MINER_EVERY,
+	}
+}
+
+func (m *Miner) Start() {
+	if !m.start(func(stop chan struct{}) {
+		repeat(stop, m.wait, m.tick)
+	}) {
+		return
+	}
+	m.showStatus()
+	timeline.add("miner", "started")
+}
+
+func (m *Miner) Stop() {
+	m.halt()
+	m.showStatus()
+	timeline.add("miner", "stopped")
+}
+
+func (m *Miner) Toggle() {
+	if m.isRunning() {
+		m.Stop()
+	} else {
+		m.Start()
+	}
+}
+
+// wait is the delay until the next block, random mode spreads blocks
+// exponentially around the interval like real mining, mempool mode polls at
+// the interval
+func (m *Miner) wait() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mode == "random" {
+		return time.Duration(rand.ExpFloat64() * float64(m.every))
+	}
+	return m.every
+}
+
+func (m *Miner) tick() {
+	m.mu.Lock()
+	mode := m.mode
+	m.mu.Unlock()
+
+	if mode == "mempool" {
+		info, err := btc.GetMempoolInfo()
+		if err != nil || info.Size == 0 {
+			return
+		}
+	}
+	if feemarket != nil && feemarket.isRunning() {
+		// keep blocks small so the fee market stays congested
+		feemarket.mineBlock()
+	} else {
+		m.launcher.generate(1)
+	}
+	m.mu.Lock()
+	m.mined++
+	m.mu.Unlock()
+	m.updateHeight()
+}
+
+// WatchHeight keeps the block height in the status line current whether or
+// not the miner is running
+func (m *Miner) WatchHeight() {
+	go (func() {
+		for {
+			m.updateHeight()
+			time.Sleep(HEIGHT_POLL)
+		}
+	})()
+}
+
+func (m *Miner) updateHeight() {
+	height, err := btc.GetBlockCount()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	changed := height != m.height
+	m.height = height
+	m.mu.Unlock()
+	if changed {
+		m.showStatus()
+	}
+}
+
+func (m *Miner) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := fmt.Sprintf("height: %d", m.height)
+	if !m.running {
+		return status + ", miner: off"
+	}
+	return fmt.Sprintf("%s, miner: %s every %s, %d mined", status, m.mode, m.every, m.mined)
+}
+
+func (m *Miner) showStatus() {
+	showAgentStatus("miner", m)
+}
+
+// minerCommand takes key=value settings like chaosCommand, e.g.
+// :miner start mode=random every=30s
+func minerCommand(args []string) string {
+	if miner == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return miner.String()
+	}
+
+	if err := agentCommand("miner", miner, args); err != nil {
+		return err.Error()
+	}
+	return miner.String()
+}
+
+func (m *Miner) set(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch key {
+	case "mode":
+		if value != "fixed" && value != "random" && value != "mempool" {
+			return fmt.Errorf("mode must be fixed, random or mempool")
+		}
+		m.mode = value
+	case "every":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid interval %s", value)
+		}
+		m.every = d
+	default:
+		return fmt.Errorf("unknown miner setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/rivo/tview"
+	"regexp"
+	"sync"
+)
+
+// A cli command runs in a pseudo terminal where there is one, what is
+// entered at the prompt while it runs goes to it so confirmations and
+// password prompts work as in a shell. Elsewhere it runs with pipes
+
+const PTY_ROWS = 40
+const PTY_COLS = 80
+
+// PTY_INTERRUPT is what ctrl+c sends through a terminal
+const PTY_INTERRUPT = "\x03"
+
+// commands running by node, one at a time per node
+var running = make(map[string]*ptyCmd)
+var runningMu sync.Mutex
+
+func runningCmd(node string) *ptyCmd {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	return running[node]
+}
+
+// track makes the command the node's running one until the returned func
+// is called
+func track(node string, p *ptyCmd) func() {
+	runningMu.Lock()
+	running[node] = p
+	runningMu.Unlock()
+	return func() {
+		runningMu.Lock()
+		delete(running, node)
+		runningMu.Unlock()
+	}
+}
+
+// a [ at the end of a chunk that may become a color tag with the next one
+var openTag = regexp.MustCompile(`\[[a-zA-Z0-9_,;: \-\."#]*\[*$`)
+
+// streamEscaper escapes output as it comes for the output pane, holding back
+// the start of a tag until the chunk that closes it
+type streamEscaper struct {
+	held string
+}
+
+func (e *streamEscaper) escape(chunk string) string {
+	text := e.held + chunk
+	e.held = ""
+	if loc := openTag.FindStringIndex(text); loc != nil {
+		text, e.held = text[:loc[0]], text[loc[0]:]
+	}
+	return tview.Escape(text)
+}
+
+func (e *streamEscaper) flush() string {
+	text := tview.Escape(e.held)
+	e.held = ""
+	return text
+}
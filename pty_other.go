@@ -0,0 +1,56 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// ptyCmd is a cli command running with pipes, there is no terminal to ask
+// for input without echo so its output comes once it exits
+type ptyCmd struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// runPty runs the command with its input open for the prompt and hands all
+// of the output to out once it exits
+func runPty(node string, cmd *exec.Cmd, cols int, out func(string)) (string, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	untrack := track(node, &ptyCmd{cmd: cmd, stdin: stdin})
+	b, err := cmd.CombinedOutput()
+	untrack()
+
+	output := strings.Replace(string(b), "\r", "", -1)
+	if output != "" {
+		out(output)
+	}
+	return output, err
+}
+
+// send passes input on, an interrupt stops the command
+func (p *ptyCmd) send(s string) error {
+	if s == PTY_INTERRUPT {
+		if p.cmd.Process == nil {
+			return fmt.Errorf("the command has not started")
+		}
+		return p.cmd.Process.Kill()
+	}
+	_, err := io.WriteString(p.stdin, s)
+	return err
+}
+
+func (p *ptyCmd) input(line string) error {
+	return p.send(line + "\n")
+}
+
+// echo is always on without a terminal
+func (p *ptyCmd) echo() bool {
+	return true
+}
@@ -0,0 +1,98 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ptyCmd is a cli command running in a pseudo terminal
+type ptyCmd struct {
+	cmd *exec.Cmd
+	tty *os.File
+	fd  int
+	// echoed is input the terminal is still to echo back, it is dropped
+	// from the output
+	echoed string
+	mu     sync.Mutex
+}
+
+// runPty runs the command in a terminal as wide as the output pane, out gets
+// the output as it comes and all of it is returned once the command exits
+func runPty(node string, cmd *exec.Cmd, cols int, out func(string)) (string, error) {
+	if cols <= 0 {
+		cols = PTY_COLS
+	}
+	tty, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: PTY_ROWS, Cols: uint16(cols)})
+	if err != nil {
+		return "", err
+	}
+	p := &ptyCmd{cmd: cmd, tty: tty, fd: int(tty.Fd())}
+	untrack := track(node, p)
+	defer (func() {
+		untrack()
+		tty.Close()
+	})()
+
+	var all strings.Builder
+	buf := make([]byte, 4096)
+	for {
+		n, err := tty.Read(buf)
+		if n > 0 {
+			chunk := p.dropEcho(strings.Replace(string(buf[:n]), "\r", "", -1))
+			all.WriteString(chunk)
+			if chunk != "" {
+				out(chunk)
+			}
+		}
+		if err != nil {
+			// EIO once the command exits and the terminal closes
+			break
+		}
+	}
+	return all.String(), cmd.Wait()
+}
+
+func (p *ptyCmd) send(s string) error {
+	_, err := p.tty.Write([]byte(s))
+	return err
+}
+
+// input sends a line typed at the prompt, what the terminal echoes of it is
+// not output of the command
+func (p *ptyCmd) input(line string) error {
+	if p.echo() {
+		p.mu.Lock()
+		p.echoed += line + "\n"
+		p.mu.Unlock()
+	}
+	return p.send(line + "\n")
+}
+
+func (p *ptyCmd) dropEcho(chunk string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.echoed == "" {
+		return chunk
+	}
+	n := min(len(p.echoed), len(chunk))
+	if chunk[:n] != p.echoed[:n] {
+		// the command changed the terminal, its output is kept as is
+		p.echoed = ""
+		return chunk
+	}
+	p.echoed = p.echoed[n:]
+	return chunk[n:]
+}
+
+// echo reports whether the terminal shows what is typed, commands turn it
+// off to read a password
+func (p *ptyCmd) echo() bool {
+	t, err := unix.IoctlGetTermios(p.fd, ioctlReadTermios)
+	return err != nil || t.Lflag&unix.ECHO != 0
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"strconv"
+	"time"
+)
+
+// Rebalancer watches the channel balances of every node and pushes funds
+// around in circles to keep channels from draining to one side
+type Rebalancer struct {
+	agent
+	threshold  float64
+	aliases    map[string]*alias
+	interval   time.Duration
+	rebalanced int
+	failed     int
+}
+
+func NewRebalancer(threshold int, aliases map[string]*alias) *Rebalancer {
+	return &Rebalancer{
+		threshold: float64(threshold) / 100,
+		aliases:   aliases,
+		interval:  REBALANCE_INTERVAL,
+	}
+}
+
+const REBALANCE_INTERVAL = 15 * time.Second
+const REBALANCE_THRESHOLD = 80
+const MAX_REBALANCE = 50000
+
+// REBALANCE_TIMEOUT bounds a circular payment so one that is stuck does not
+// hold up the later rounds
+const REBALANCE_TIMEOUT = time.Minute
+
+func (r *Rebalancer) Start() {
+	if !r.start(func(stop chan struct{}) {
+		repeat(stop, r.wait, r.tick)
+	}) {
+		return
+	}
+	r.showStatus()
+	timeline.add("rebalance", "started")
+}
+
+func (r *Rebalancer) Stop() {
+	r.halt()
+	r.showStatus()
+	timeline.add("rebalance", "stopped")
+}
+
+func (r *Rebalancer) wait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interval
+}
+
+func (r *Rebalancer) tick() {
+	for _, a := range r.aliases {
+		if !r.isRunning() {
+			return
+		}
+		ok, tried := r.rebalanceNode(a)
+		if !tried {
+			continue
+		}
+		r.mu.Lock()
+		if ok {
+			r.rebalanced++
+		} else {
+			r.failed++
+		}
+		r.mu.Unlock()
+		r.showStatus()
+	}
+}
+
+func (r *Rebalancer) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.running {
+		return "rebalance: off"
+	}
+	return fmt.Sprintf("rebalance: above %.0f%% every %s, %d moved, %d failed", r.threshold*100, r.interval, r.rebalanced, r.failed)
+}
+
+func (r *Rebalancer) showStatus() {
+	showAgentStatus("rebalance", r)
+}
+
+func (r *Rebalancer) set(key, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch key {
+	case "threshold":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 50 || n >= 100 {
+			return fmt.Errorf("threshold must be between 51 and 99")
+		}
+		r.threshold = float64(n) / 100
+	case "every":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid interval %s", value)
+		}
+		r.interval = d
+	default:
+		return fmt.Errorf("unknown rebalance setting %s", key)
+	}
+	return nil
+}
+
+// rebalanceCommand takes key=value settings like chaosCommand, e.g.
+// :rebalance start threshold=70 every=30s
+func rebalanceCommand(args []string) string {
+	if rebalancer == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return rebalancer.String()
+	}
+
+	if err := agentCommand("rebalance", rebalancer, args); err != nil {
+		return err.Error()
+	}
+	return rebalancer.String()
+}
+
+func localRatio(c *lnrpc.Channel) float64 {
+	total := c.LocalBalance + c.RemoteBalance
+	if total == 0 {
+		return 0.5
+	}
+	return float64(c.LocalBalance) / float64(total)
+}
+
+// rebalanceNode finds the channel with the most local balance above the
+// threshold and sends a payment to self out through it and back in through
+// the channel with the least local balance. tried is false when there was
+// nothing to do
+func (r *Rebalancer) rebalanceNode(a *alias) (ok bool, tried bool) {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REBALANCE_TIMEOUT)
+	defer cancel()
+	chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	threshold := r.threshold
+	r.mu.Unlock()
+	var out, in *lnrpc.Channel
+	for _, c := range chans.Channels {
+		if localRatio(c) >= threshold && (out == nil || localRatio(c) > localRatio(out)) {
+			out = c
+		}
+	}
+	if out == nil {
+		return
+	}
+	for _, c := range chans.Channels {
+		if c.RemotePubkey == out.RemotePubkey || localRatio(c) >= 0.5 {
+			continue
+		}
+		if in == nil || localRatio(c) < localRatio(in) {
+			in = c
+		}
+	}
+	if in == nil {
+		return
+	}
+
+	excess := out.LocalBalance - (out.LocalBalance+out.RemoteBalance)/2
+	deficit := (in.LocalBalance+in.RemoteBalance)/2 - in.LocalBalance
+	amt := excess
+	if deficit < amt {
+		amt = deficit
+	}
+	if amt > MAX_REBALANCE {
+		amt = MAX_REBALANCE
+	}
+	if amt <= 0 {
+		return
+	}
+
+	lasthop, err := hex.DecodeString(in.RemotePubkey)
+	if err != nil {
+		return
+	}
+	tried = true
+
+	inv, err := rpc.AddInvoice(ctx, &lnrpc.Invoice{
+		Value: amt,
+		Memo:  fmt.Sprintf("rebalance %d -> %d", out.ChanId, in.ChanId),
+	})
+	if err != nil {
+		logger.logerr("rebalance invoice failure", err.Error())
+		return
+	}
+
+	resp, err := rpc.SendPaymentSync(ctx, &lnrpc.SendRequest{
+		PaymentRequest:   inv.PaymentRequest,
+		OutgoingChanId:   out.ChanId,
+		LastHopPubkey:    lasthop,
+		AllowSelfPayment: true,
+	})
+	if err != nil {
+		logger.logerr("rebalance payment failure", err.Error())
+		return
+	}
+	if resp.PaymentError != "" {
+		logger.logerr(fmt.Sprintf("rebalance %s", *a.Name), resp.PaymentError)
+		return
+	}
+	logger.log(fmt.Sprintf("[green]rebalanced:[white] %s moved %d sat from %d to %d", *a.Name, amt, out.ChanId, in.ChanId))
+	return true, true
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nodeSnapshot is what a reorg report compares for each node before and
+// after the chain changes
+type nodeSnapshot struct {
+	height      uint32
+	hash        string
+	synced      bool
+	active      int
+	pendingOpen int
+	closing     int
+	chanpoints  map[string]bool
+}
+
+const REORG_SYNC_TIMEOUT = 30 * time.Second
+
+type reorgOptions struct {
+	depth   int
+	mine    int
+	drop    []string
+	replace []string
+}
+
+// reorg orphans the last depth blocks and mines a competing chain from the
+// transactions they contained, leaving out or replacing the requested ones
+func reorg(aliases map[string]*alias, opts *reorgOptions) (string, error) {
+	height, err := btc.GetBlockCount()
+	if err != nil {
+		return "", err
+	}
+	if opts.depth < 1 || opts.depth >= height {
+		return "", fmt.Errorf("cannot orphan %d blocks at height %d", opts.depth, height)
+	}
+	fork := height - opts.depth + 1
+
+	forkhash, err := btc.GetBlockHash(fork)
+	if err != nil {
+		return "", err
+	}
+
+	before := snapshots(aliases)
+
+	drop := make(map[string]bool)
+	for _, txid := range opts.drop {
+		if txid == "funding" {
+			for _, f := range fundingTxids(aliases, fork, height) {
+				drop[f] = true
+			}
+			continue
+		}
+		drop[txid] = true
+	}
+
+	if err := btc.InvalidateBlock(forkhash); err != nil {
+		return "", err
+	}
+	timeline.add("reorg", "invalidated %d blocks from height %d %s", opts.depth, fork, forkhash)
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "orphaned %d blocks from height %d\n", opts.depth, fork)
+
+	if opts.mine > 0 {
+		txs, excluded, err := competingTxs(drop, opts.replace)
+		if err != nil {
+			return "", err
+		}
+		address, err := btc.GetNewAddress()
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < opts.mine; i++ {
+			blocktxs := []string{}
+			if i == 0 {
+				blocktxs = txs
+			}
+			if _, err := btc.GenerateBlock(address, blocktxs); err != nil {
+				return report.String(), err
+			}
+		}
+		timeline.add("reorg", "mined %d competing blocks, %d transactions left out", opts.mine, len(excluded))
+		fmt.Fprintf(&report, "mined %d competing blocks, new height %d\n", opts.mine, fork-1+opts.mine)
+		for _, txid := range excluded {
+			fmt.Fprintf(&report, "left out %s\n", txid)
+		}
+		for _, txid := range opts.replace {
+			fmt.Fprintf(&report, "replaced %s\n", txid)
+		}
+	}
+
+	target := uint32(fork - 1 + opts.mine)
+	after := waitForSync(aliases, target)
+	report.WriteString(reorgReport(aliases, before, after))
+	return report.String(), nil
+}
+
+// competingTxs returns the mempool transactions to put in the first block of
+// the competing chain, the txids that were left out along with everything
+// spending them, and signed replacements for the transactions to replace
+func competingTxs(drop map[string]bool, replace []string) ([]string, []string, error) {
+	for _, txid := range replace {
+		drop[txid] = true
+	}
+
+	mempool, err := btc.GetRawMempool()
+	if err != nil {
+		return nil, nil, err
+	}
+	for txid := range drop {
+		descendants, err := btc.GetMempoolDescendants(txid)
+		if err != nil {
+			continue
+		}
+		for _, d := range descendants {
+			drop[d] = true
+		}
+	}
+
+	txs := make([]string, 0, len(mempool))
+	excluded := make([]string, 0)
+	for _, txid := range mempool {
+		if drop[txid] {
+			excluded = append(excluded, txid)
+			continue
+		}
+		txs = append(txs, txid)
+	}
+	sort.Strings(excluded)
+
+	// generateblock needs parents before children
+	txs = ancestorOrder(txs)
+
+	for _, txid := range replace {
+		raw, err := conflictingTx(txid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot replace %s: %s", txid, err.Error())
+		}
+		txs = append(txs, raw)
+	}
+	return txs, excluded, nil
+}
+
+func ancestorOrder(txids []string) []string {
+	count := make(map[string]int)
+	for _, txid := range txids {
+		if entry, err := btc.GetMempoolEntry(txid); err == nil {
+			count[txid] = entry.Ancestorcount
+		}
+	}
+	sort.SliceStable(txids, func(i, j int) bool { return count[txids[i]] < count[txids[j]] })
+	return txids
+}
+
+// conflictingTx double spends the inputs of a bitcoind wallet transaction
+// back to the wallet, lnd owned inputs like channel funding can't be signed
+// here so those can only be left out
+func conflictingTx(txid string) (string, error) {
+	tx, err := btc.GetRawTransaction(txid)
+	if err != nil {
+		return "", err
+	}
+	total := 0.0
+	for _, out := range tx.Vout {
+		total += out.Value
+	}
+	inputs := make([]TxInput, 0, len(tx.Vin))
+	for _, in := range tx.Vin {
+		inputs = append(inputs, TxInput{in.Txid, in.Vout})
+	}
+	address, err := btc.GetNewAddress()
+	if err != nil {
+		return "", err
+	}
+	// pay slightly more fee than the original so the two differ
+	outputs := map[string]float64{address: btcAmount(total - 0.00001)}
+	raw, err := btc.CreateRawTransaction(inputs, outputs)
+	if err != nil {
+		return "", err
+	}
+	signed, err := btc.SignRawTransactionWithWallet(raw)
+	if err != nil {
+		return "", err
+	}
+	if !signed.Complete {
+		return "", fmt.Errorf("inputs are not owned by the bitcoind wallet")
+	}
+	return signed.Hex, nil
+}
+
+// fundingTxids finds the funding transactions of every node's channels that
+// confirmed between the from and to heights
+func fundingTxids(aliases map[string]*alias, from, to int) []string {
+	found := make(map[string]bool)
+	ctx := context.Background()
+	for _, a := range aliases {
+		rpc := grpcClient(a)
+		if rpc == nil {
+			continue
+		}
+		chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+		if err != nil {
+			continue
+		}
+		for _, c := range chans.Channels {
+			// the block height is the top 3 bytes of the short channel id
+			h := int(c.ChanId >> 40)
+			if h >= from && h <= to {
+				found[strings.Split(c.ChannelPoint, ":")[0]] = true
+			}
+		}
+	}
+	txids := make([]string, 0, len(found))
+	for txid := range found {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	return txids
+}
+
+func snapshot(a *alias) *nodeSnapshot {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return nil
+	}
+	ctx := context.Background()
+	info, err := rpc.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return nil
+	}
+	s := &nodeSnapshot{
+		height:     info.BlockHeight,
+		hash:       info.BlockHash,
+		synced:     info.SyncedToChain,
+		chanpoints: make(map[string]bool),
+	}
+	if chans, err := rpc.ListChannels(ctx, &lnrpc.ListChannelsRequest{}); err == nil {
+		for _, c := range chans.Channels {
+			if c.Active {
+				s.active++
+			}
+			s.chanpoints[c.ChannelPoint] = true
+		}
+	}
+	if pending, err := rpc.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{}); err == nil {
+		s.pendingOpen = len(pending.PendingOpenChannels)
+		s.closing = len(pending.WaitingCloseChannels) + len(pending.PendingForceClosingChannels)
+	}
+	return s
+}
+
+func snapshots(aliases map[string]*alias) map[string]*nodeSnapshot {
+	snaps := make(map[string]*nodeSnapshot)
+	for name, a := range aliases {
+		snaps[name] = snapshot(a)
+	}
+	return snaps
+}
+
+// waitForSync polls the nodes until they all reach the height or the timeout
+// passes, nodes that never get there show up as lagging in the report
+func waitForSync(aliases map[string]*alias, height uint32) map[string]*nodeSnapshot {
+	deadline := time.Now().Add(REORG_SYNC_TIMEOUT)
+	for {
+		snaps := snapshots(aliases)
+		synced := true
+		for _, s := range snaps {
+			if s == nil || s.height != height {
+				synced = false
+			}
+		}
+		if synced || time.Now().After(deadline) {
+			return snaps
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func reorgReport(aliases map[string]*alias, before, after map[string]*nodeSnapshot) string {
+	var b strings.Builder
+	for _, name := range sortAliasKeys(aliases) {
+		pre, post := before[name], after[name]
+		if pre == nil || post == nil {
+			fmt.Fprintf(&b, "%s: not reachable\n", name)
+			continue
+		}
+		fmt.Fprintf(&b, "%s: height %d -> %d synced %t, active channels %d -> %d, pending open %d -> %d, closing %d -> %d\n",
+			name, pre.height, post.height, post.synced, pre.active, post.active, pre.pendingOpen, post.pendingOpen, pre.closing, post.closing)
+		for point := range pre.chanpoints {
+			if !post.chanpoints[point] {
+				fmt.Fprintf(&b, "    channel %s no longer open\n", point)
+			}
+		}
+	}
+	return b.String()
+}
+
+// reorgCommand parses :reorg <n> [mine=n+1] [drop=funding|txid,...] [replace=txid,...]
+func reorgCommand(args []string) string {
+	if act == nil {
+		return "network not launched"
+	}
+	if len(args) == 0 {
+		return "usage: reorg <blocks> [mine=<blocks>] [drop=funding|txid,...] [replace=txid,...]"
+	}
+	depth, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Sprintf("invalid block count %s", args[0])
+	}
+	opts := &reorgOptions{depth: depth, mine: depth + 1}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Sprintf("invalid setting %s, expected key=value", arg)
+		}
+		switch kv[0] {
+		case "mine":
+			opts.mine, err = strconv.Atoi(kv[1])
+			if err != nil || opts.mine < 0 {
+				return fmt.Sprintf("invalid block count %s", kv[1])
+			}
+		case "drop":
+			opts.drop = strings.Split(kv[1], ",")
+		case "replace":
+			opts.replace = strings.Split(kv[1], ",")
+		default:
+			return fmt.Sprintf("unknown reorg setting %s", kv[0])
+		}
+	}
+	if len(opts.drop)+len(opts.replace) > 0 && opts.mine == 0 {
+		return "drop and replace need a competing chain, use mine=1 or more"
+	}
+
+	report, err := reorg(act.aliases, opts)
+	if err != nil {
+		return fmt.Sprintf("%s\nreorg failed: %s", report, err.Error())
+	}
+	return report
+}
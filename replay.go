@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PaymentRecord is one line of a payment log, nodes are stored by alias and
+// by their userN index so a log can be replayed against an environment
+// launched with different random names
+type PaymentRecord struct {
+	Src      string `json:"src"`
+	Dest     string `json:"dest"`
+	SrcNode  int    `json:"src_node"`
+	DestNode int    `json:"dest_node"`
+	Amount   int    `json:"amount"`
+	Memo     string `json:"memo"`
+	Type     string `json:"type"`
+	OffsetMs int64  `json:"offset_ms"`
+}
+
+const PAYMENT_INVOICE = "invoice"
+
+// Recorder writes the payments as they are sent, offsets count from the
+// first one so the launch is not part of the log
+type Recorder struct {
+	path  string
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+	n     int
+	mu    sync.Mutex
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(expandHome(path), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		path: path,
+		f:    f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+func (r *Recorder) record(src, dest *alias, amt int, memo, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	err := r.enc.Encode(&PaymentRecord{
+		Src:      *src.Name,
+		Dest:     *dest.Name,
+		SrcNode:  src.index(),
+		DestNode: dest.index(),
+		Amount:   amt,
+		Memo:     memo,
+		Type:     kind,
+		OffsetMs: int64(time.Since(r.start) / time.Millisecond),
+	})
+	if err != nil {
+		timeline.add("record", "write to %s failed: %s", r.path, err.Error())
+		return
+	}
+	r.n++
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("recording: %d to %s", r.n, r.path)
+}
+
+// Replay plays a payment log back, speed divides the original delays between
+// payments and a speed of 0 sends them back to back
+type Replay struct {
+	records []*PaymentRecord
+	aliases map[string]*alias
+	speed   float64
+	sent    int
+	failed  int
+	stopped bool
+	mu      sync.Mutex
+}
+
+var replay *Replay
+var replayMu sync.Mutex
+
+func NewReplay(path string, speed float64, aliases map[string]*alias) (*Replay, error) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make([]*PaymentRecord, 0)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		r := &PaymentRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, line, err.Error())
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Replay{
+		records: records,
+		aliases: aliases,
+		speed:   speed,
+	}, nil
+}
+
+// resolve finds the node by alias first and falls back to the node with the
+// same userN index
+func (r *Replay) resolve(name string, index int) *alias {
+	if a, ok := r.aliases[name]; ok {
+		return a
+	}
+	for _, a := range r.aliases {
+		if a.index() == index {
+			return a
+		}
+	}
+	return nil
+}
+
+func (r *Replay) Run() {
+	go (func() {
+		start := time.Now()
+		for _, rec := range r.records {
+			if r.speed > 0 {
+				due := start.Add(time.Duration(float64(rec.OffsetMs)/r.speed) * time.Millisecond)
+				time.Sleep(time.Until(due))
+			}
+			r.mu.Lock()
+			stopped := r.stopped
+			r.mu.Unlock()
+			if stopped {
+				break
+			}
+
+			src := r.resolve(rec.Src, rec.SrcNode)
+			dest := r.resolve(rec.Dest, rec.DestNode)
+			err := fmt.Errorf("unknown type %s", rec.Type)
+			if src == nil || dest == nil {
+				err = fmt.Errorf("no node for %s -> %s", rec.Src, rec.Dest)
+			} else if rec.Type == PAYMENT_INVOICE {
+				err = pay(src, dest, rec.Amount, rec.Memo)
+			}
+
+			r.mu.Lock()
+			r.sent++
+			if err != nil {
+				r.failed++
+			}
+			r.mu.Unlock()
+			if err != nil {
+				timeline.add("replay", "%s -> %s %d sat failed: %s", rec.Src, rec.Dest, rec.Amount, err.Error())
+			}
+			r.showStatus()
+		}
+		timeline.add("replay", "finished %s", r.String())
+		r.showStatus()
+	})()
+}
+
+func (r *Replay) Stop() {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+}
+
+func (r *Replay) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("replay: %d/%d sent, %d failed", r.sent, len(r.records), r.failed)
+}
+
+func (r *Replay) showStatus() {
+	ui.setStatus("replay", r.String())
+	app.Draw()
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return userdir + path[1:]
+	}
+	return path
+}
+
+// replayCommand starts or stops playing back a payment log, e.g.
+// :replay start payments.jsonl speed=10
+func replayCommand(args []string) string {
+	if act == nil {
+		return "network not launched"
+	}
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if len(args) == 0 {
+		if replay == nil {
+			return "no replay running"
+		}
+		return replay.String()
+	}
+
+	switch args[0] {
+	case "stop":
+		if replay == nil {
+			return "no replay running"
+		}
+		replay.Stop()
+		return replay.String()
+	case "start":
+		if len(args) < 2 {
+			return "usage: replay start <file> [speed=1]"
+		}
+		speed := 1.0
+		for _, arg := range args[2:] {
+			if !strings.HasPrefix(arg, "speed=") {
+				return fmt.Sprintf("unknown replay setting %s", arg)
+			}
+			s, err := strconv.ParseFloat(strings.TrimPrefix(arg, "speed="), 64)
+			if err != nil || s < 0 {
+				return fmt.Sprintf("invalid speed %s", arg)
+			}
+			speed = s
+		}
+		r, err := NewReplay(args[1], speed, act.aliases)
+		if err != nil {
+			return err.Error()
+		}
+		if replay != nil {
+			replay.Stop()
+		}
+		replay = r
+		timeline.add("replay", "started %d payments from %s at speed %g", len(r.records), args[1], speed)
+		replay.Run()
+		return fmt.Sprintf("replaying %d payments from %s", len(r.records), args[1])
+	}
+	return fmt.Sprintf("unknown replay command %s", args[0])
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"time"
+)
+
+// Scenarios drive the network through on-chain situations that take many
+// manual steps to reproduce
+type Scenarios struct {
+	aliases  map[string]*alias
+	launcher *Launcher
+}
+
+var scenarios *Scenarios
+
+const SCENARIO_TIMEOUT = 60 * time.Second
+
+func NewScenarios(aliases map[string]*alias, launcher *Launcher) *Scenarios {
+	return &Scenarios{
+		aliases:  aliases,
+		launcher: launcher,
+	}
+}
+
+// findChannel returns a's channel with b, or any active channel of a if b is nil
+func findChannel(a, b *alias) (*lnrpc.Channel, error) {
+	rpc := grpcClient(a)
+	if rpc == nil {
+		return nil, fmt.Errorf("cannot connect to %s", *a.Name)
+	}
+	chans, err := rpc.ListChannels(context.Background(), &lnrpc.ListChannelsRequest{ActiveOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	pubkey := ""
+	if b != nil {
+		info := nodeInfo(b)
+		if info == nil {
+			return nil, fmt.Errorf("cannot get info from %s", *b.Name)
+		}
+		pubkey = info.IdentityPubkey
+	}
+	for _, c := range chans.Channels {
+		if pubkey == "" || c.RemotePubkey == pubkey {
+			return c, nil
+		}
+	}
+	if b == nil {
+		return nil, fmt.Errorf("%s has no active channels", *a.Name)
+	}
+	return nil, fmt.Errorf("%s has no active channel with %s", *a.Name, *b.Name)
+}
+
+// waitActive waits for a channel to be active again after a restart
+func waitActive(a *alias, chanid uint64) error {
+	deadline := time.Now().Add(SCENARIO_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if rpc := grpcClient(a); rpc != nil {
+			chans, err := rpc.ListChannels(context.Background(), &lnrpc.ListChannelsRequest{ActiveOnly: true})
+			if err == nil {
+				for _, c := range chans.Channels {
+					if c.ChanId == chanid {
+						return nil
+					}
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("channel %d of %s did not become active", chanid, *a.Name)
+}
+
+type txOutput struct {
+	Value        float64 `json:"value"`
+	N            int     `json:"n"`
+	ScriptPubKey struct {
+		Address string `json:"address"`
+		Type    string `json:"type"`
+	} `json:"scriptPubKey"`
+}
+
+type rawTx struct {
+	Txid string `json:"txid"`
+	Vin  []struct {
+		Txid     string `json:"txid"`
+		Vout     int    `json:"vout"`
+		Coinbase string `json:"coinbase"`
+	} `json:"vin"`
+	Vout      []*txOutput `json:"vout"`
+	Vsize     int         `json:"vsize"`
+	Blockhash string      `json:"blockhash"`
+}
+
+// spender scans the blocks from the height up to the tip for the transaction
+// spending an output, it returns an empty txid while the output is unspent
+func spender(txid string, vout int, from int) (string, int, error) {
+	tip, err := btc.GetBlockCount()
+	if err != nil {
+		return "", 0, err
+	}
+	for h := from; h <= tip; h++ {
+		hash, err := btc.GetBlockHash(h)
+		if err != nil {
+			return "", 0, err
+		}
+		block, err := btc.GetBlock(hash)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, tx := range block.Tx {
+			for _, in := range tx.Vin {
+				if in.Txid == txid && in.Vout == vout {
+					return tx.Txid, h, nil
+				}
+			}
+		}
+	}
+	return "", 0, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gdamore/tcell"
+	"github.com/rivo/tview"
+	"regexp"
+	"strings"
+)
+
+// Search finds text in the command output as it is typed, the current node's
+// or every node's, and can narrow it to the matching lines
+type Search struct {
+	*tview.Flex
+	input   *tview.InputField
+	view    *tview.TextView
+	matches int
+	current int
+	filter  bool
+	all     bool
+}
+
+var search *Search
+
+func NewSearch() *Search {
+	s := &Search{
+		Flex:  tview.NewFlex().SetDirection(tview.FlexRow),
+		input: tview.NewInputField().SetLabel("Search: ").SetFieldBackgroundColor(tcell.ColorBlack),
+		view:  tview.NewTextView().SetDynamicColors(true).SetRegions(true),
+	}
+	s.view.SetBorder(true)
+	s.AddItem(s.input, 1, 0, true)
+	s.AddItem(s.view, 0, 1, false)
+
+	s.input.SetChangedFunc(func(text string) {
+		s.current = 0
+		s.render()
+	})
+	s.input.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
+		switch key.Key() {
+		case tcell.KeyEnter, tcell.KeyDown:
+			s.step(1)
+		case tcell.KeyUp:
+			s.step(-1)
+		case tcell.KeyF2:
+			s.filter = !s.filter
+			s.current = 0
+			s.render()
+		case tcell.KeyF3:
+			s.all = !s.all
+			s.current = 0
+			s.render()
+		case tcell.KeyPgUp, tcell.KeyPgDn, tcell.KeyHome, tcell.KeyEnd:
+			s.view.InputHandler()(key, func(tview.Primitive) {})
+		case tcell.KeyEscape:
+			ui.togglePane("search", s)
+		default:
+			return key
+		}
+		return nil
+	})
+	s.updateTitle()
+	return s
+}
+
+// Show searches the output again, it may have grown since the last time
+func (s *Search) Show() {
+	s.render()
+}
+
+func (s *Search) Hide() {
+}
+
+// plainText is the node buffer as shown, without the color tags around
+// commands and with the escaped output as it was printed
+func plainText(markup string) string {
+	return tview.NewTextView().SetDynamicColors(true).SetText(markup).GetText(true)
+}
+
+// pattern is the query as a case insensitive regex, or as plain text when it
+// is not a valid one
+func (s *Search) pattern() *regexp.Regexp {
+	query := s.input.GetText()
+	if query == "" {
+		return nil
+	}
+	re, err := regexp.Compile("(?i)" + query)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	}
+	return re
+}
+
+func (s *Search) render() {
+	re := s.pattern()
+	names := []string{ui.currentnode}
+	if s.all {
+		names = sortAliasKeys(ui.aliases)
+	}
+
+	var b strings.Builder
+	s.matches = 0
+	for _, name := range names {
+		n, ok := ui.nodes[name]
+		if !ok {
+			continue
+		}
+		if s.all {
+			fmt.Fprintf(&b, "[#00aaaa]== %s[white]\n", name)
+		}
+		for i, line := range strings.Split(plainText(n.Buff), "\n") {
+			marked, found := s.mark(line, re)
+			if s.filter && re != nil && found == 0 {
+				continue
+			}
+			if s.filter {
+				fmt.Fprintf(&b, "[gray]%5d[white] ", i+1)
+			}
+			b.WriteString(marked + "\n")
+		}
+	}
+	if s.current >= s.matches {
+		s.current = 0
+	}
+	s.view.SetText(b.String())
+	s.highlight()
+}
+
+// mark escapes the line and puts every match in its own region so the
+// current one can be highlighted, it returns how many it found
+func (s *Search) mark(line string, re *regexp.Regexp) (string, int) {
+	if re == nil {
+		return tview.Escape(line), 0
+	}
+	var b strings.Builder
+	last := 0
+	found := 0
+	for _, m := range re.FindAllStringIndex(line, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		fmt.Fprintf(&b, "%s[\"%d\"][black:yellow]%s[-:-][\"\"]", tview.Escape(line[last:m[0]]), s.matches, tview.Escape(line[m[0]:m[1]]))
+		last = m[1]
+		s.matches++
+		found++
+	}
+	b.WriteString(tview.Escape(line[last:]))
+	return b.String(), found
+}
+
+// step moves to the next or previous match, wrapping around
+func (s *Search) step(by int) {
+	if s.matches == 0 {
+		return
+	}
+	s.current = (s.current + by + s.matches) % s.matches
+	s.highlight()
+}
+
+func (s *Search) highlight() {
+	if s.matches > 0 {
+		s.view.Highlight(fmt.Sprintf("%d", s.current))
+		s.view.ScrollToHighlight()
+	} else {
+		s.view.Highlight()
+		s.view.ScrollToBeginning()
+	}
+	s.updateTitle()
+}
+
+func (s *Search) updateTitle() {
+	scope := ui.currentnode
+	if s.all {
+		scope = "all nodes"
+	}
+	mode := "search"
+	if s.filter {
+		mode = "filter"
+	}
+	count := "no matches"
+	if s.matches > 0 {
+		count = fmt.Sprintf("%d of %d", s.current+1, s.matches)
+	}
+	s.view.SetTitle(fmt.Sprintf("%s %s, %s (Up/Down, F2 filter, F3 all nodes, Esc to close)", mode, scope, count))
+}
@@ -6,11 +6,14 @@ import (
 	"github.com/atotto/clipboard"
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 )
 
@@ -18,9 +21,18 @@ type MainUI struct {
 	cli         *tview.InputField
 	list        *tview.DropDown
 	cliresult   *tview.TextView
+	status      *tview.TextView
+	body        *tview.Pages
+	pane        string
+	panes       map[string]Pane
 	currentnode string
+	nodeMu      sync.Mutex
 	aliases     map[string]*alias
 	nodes       map[string]*node
+	statuses    map[string]string
+	statuskeys  []string
+	statusMu    sync.Mutex
+	rsearch     *reverseSearch
 }
 
 var userdir string
@@ -41,16 +53,23 @@ func NewMainUI() *MainUI {
 	}
 
 	ensureDir(dir)
-	ensureDir(path.Join(dir, "bitcoin"))
+	history = NewHistory(path.Join(userdir, HISTORY_DIR))
 
 	ui := &MainUI{
 		cliresult: tview.NewTextView().SetDynamicColors(true),
 		cli:       tview.NewInputField(),
+		status:    tview.NewTextView().SetDynamicColors(true),
+		body:      tview.NewPages(),
+		pane:      "output",
+		panes:     make(map[string]Pane),
 		list:      tview.NewDropDown(),
 		aliases:   make(map[string]*alias),
 		nodes:     make(map[string]*node),
+		statuses:  make(map[string]string),
 	}
 	ui.cliresult.SetBorder(false)
+	ui.status.SetTextColor(tcell.ColorYellow)
+	ui.body.AddPage("output", ui.cliresult, true, true)
 
 	ui.cliresult.SetInputCapture(func(key *tcell.EventKey) *tcell.EventKey {
 		if key.Key() == tcell.KeyCtrlL {
@@ -61,7 +80,7 @@ func NewMainUI() *MainUI {
 	})
 
 	ui.cli.
-		SetPlaceholder("Enter cli command - use Ctrl+v to paste (no shift)").
+		SetPlaceholder("Enter cli command, @all <command> for every node, $Smith.pubkey for values - use Ctrl+v to paste (no shift)").
 		SetFieldBackgroundColor(tcell.ColorBlack).
 		SetFieldWidth(0).SetBorder(true).SetTitle("CLI (Ctrl+i) for CLI (Ctrl+o) for results")
 
@@ -71,45 +90,129 @@ func NewMainUI() *MainUI {
 
 }
 
+// addOutput appends markup to the node's output, and to the pane when the
+// node is shown. It runs on the ui goroutine
+func (u *MainUI) addOutput(node, markup string) {
+	u.nodes[node].Buff += markup
+	if node == u.currentnode {
+		fmt.Fprint(u.cliresult, markup)
+		u.cliresult.ScrollToEnd()
+	}
+}
+
 func (u *MainUI) cliInputCapture(key *tcell.EventKey) *tcell.EventKey {
+	if u.rsearch != nil {
+		if key = u.reverseSearchKey(key); key == nil {
+			return nil
+		}
+	}
+	if p := runningCmd(u.currentnode); p != nil {
+		// mask what is typed while the command reads a password
+		if p.echo() {
+			u.cli.SetMaskCharacter(0)
+		} else {
+			u.cli.SetMaskCharacter('*')
+		}
+	}
 	if key.Key() == tcell.KeyEnter {
-		go (func() {
-			cmdnode := u.currentnode
-			text := u.cli.GetText()
-			cmdfmt := fmt.Sprintf("[#00aaaa]# %s[white]\n", text)
-			if text == "" {
-				fmt.Fprintf(u.cliresult, "Please provide a command to execute\n")
-			}
-			args, err := parseCommandLine(text)
-			if err != nil {
-				fmt.Fprintf(u.cliresult, "%s\n", err.Error())
+		cmdnode := u.currentnode
+		text := u.cli.GetText()
+		u.cli.SetText("")
+		if p := runningCmd(cmdnode); p != nil {
+			// the node's command is waiting for input, it is shown as typed
+			// unless it is a password
+			if p.echo() {
+				u.addOutput(cmdnode, tview.Escape(text)+"\n")
 			}
+			p.input(text)
+			return nil
+		}
+		if text == "" {
+			fmt.Fprintf(u.cliresult, "Please provide a command to execute\n")
+			return nil
+		}
+		cmdfmt := fmt.Sprintf("[#00aaaa]# %s[white]\n", tview.Escape(text))
 
-			u.cli.SetText("")
-			app.Draw()
+		n := u.nodes[cmdnode]
+		cmdsize := len(n.Cmds)
+		if *n.CmdIndex == -1 || n.Cmds[cmdsize-1] != text {
+			n.Cmds = append(n.Cmds, text)
+			history.add(historyKey(u.aliases[cmdnode]), text)
+		}
+		*n.CmdIndex = len(n.Cmds)
 
-			cmd := u.aliases[cmdnode].Command(args...)
-			out, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Fprintf(u.cliresult, "%s\n", err.Error())
+		_, _, width, _ := u.cliresult.GetInnerRect()
+		go (func() {
+			output := func(markup string) {
+				app.QueueUpdateDraw(func() {
+					u.addOutput(cmdnode, markup)
+				})
 			}
 
-			if cmdnode == u.currentnode {
-				fmt.Fprintf(u.cliresult, cmdfmt)
-				fmt.Fprintf(u.cliresult, "%s\n", tview.Escape(string(out)))
-				u.cliresult.ScrollToEnd()
-				app.Draw()
+			var out string
+			var tail string
+			streamed := false
+			failed := false
+			expanded, err := interpolate(text, u.aliases)
+			if err != nil {
+				out = err.Error()
+				failed = true
+			} else if isCommand(expanded) {
+				out = runCommand(expanded)
+			} else if isBroadcast(expanded) {
+				out = u.broadcast(expanded)
+			} else {
+				// output is shown as it comes so prompts are seen before
+				// the command waits on them
+				output(cmdfmt)
+				streamed = true
+
+				// a command that does not parse is not run at all
+				args, err := parseCommandLine(expanded)
+				if err != nil {
+					tail = tview.Escape(err.Error()) + "\n"
+					failed = true
+				} else {
+					cmd := u.aliases[cmdnode].Command(args...)
+					esc := &streamEscaper{}
+					out, err = runPty(cmdnode, cmd, width, func(chunk string) {
+						output(esc.escape(chunk))
+					})
+					tail = esc.flush()
+					if err != nil {
+						out += err.Error() + "\n"
+						tail += tview.Escape(err.Error()) + "\n"
+						failed = true
+					}
+					app.QueueUpdateDraw(func() {
+						u.cli.SetMaskCharacter(0)
+					})
+				}
 			}
-			u.nodes[cmdnode].Buff += cmdfmt
-			u.nodes[cmdnode].Buff += string(out) + "\n"
-
-			cmdsize := len(u.nodes[cmdnode].Cmds)
-			if *u.nodes[cmdnode].CmdIndex == -1 || u.nodes[cmdnode].Cmds[cmdsize-1] != text {
-				u.nodes[cmdnode].Cmds = append(u.nodes[cmdnode].Cmds, text)
+			// only output of a command that succeeded is kept for $last
+			if !failed {
+				setLastOutput(out)
 			}
-			*u.nodes[cmdnode].CmdIndex = len(u.nodes[cmdnode].Cmds)
 
+			completer.harvest(out)
+
+			if streamed {
+				output(tail + "\n")
+			} else {
+				output(cmdfmt + tview.Escape(out) + "\n")
+			}
 		})()
+	} else if key.Key() == tcell.KeyEscape {
+		if p := runningCmd(u.currentnode); p != nil {
+			p.send(PTY_INTERRUPT)
+			return nil
+		}
+	} else if key.Key() == tcell.KeyCtrlR {
+		u.startReverseSearch()
+		return nil
+	} else if key.Key() == tcell.KeyTab {
+		u.complete()
+		return nil
 	} else if key.Key() == tcell.KeyUp {
 		index := u.nodes[u.currentnode].CmdIndex
 		if *index > 0 {
@@ -144,44 +247,113 @@ func (u *MainUI) cliInputCapture(key *tcell.EventKey) *tcell.EventKey {
 
 }
 
+// Pane is a view shown in place of the command output, it only polls its
+// nodes while it is showing
+type Pane interface {
+	tview.Primitive
+	Show()
+	Hide()
+}
+
+// togglePane shows a pane in place of the command output, or the output
+// again if the pane is already showing
+func (u *MainUI) togglePane(name string, p Pane) {
+	if cur, ok := u.panes[u.pane]; ok {
+		cur.Hide()
+	}
+	if u.pane == name {
+		u.pane = "output"
+		u.body.SwitchToPage("output")
+		app.SetFocus(u.cli)
+		return
+	}
+	if _, ok := u.panes[name]; !ok {
+		u.panes[name] = p
+		u.body.AddPage(name, p, true, false)
+	}
+	u.pane = name
+	u.body.SwitchToPage(name)
+	app.SetFocus(p)
+	p.Show()
+}
+
+// selectNode switches the cli and output to a node, it runs on the ui
+// goroutine
+func (u *MainUI) selectNode(name string) {
+	u.nodeMu.Lock()
+	u.currentnode = name
+	u.nodeMu.Unlock()
+	u.cli.SetText("")
+	u.cliresult.SetText(u.nodes[name].Buff)
+	app.SetFocus(u.cli)
+}
+
+// selectedNode is the current node for goroutines other than the ui's
+func (u *MainUI) selectedNode() string {
+	u.nodeMu.Lock()
+	defer u.nodeMu.Unlock()
+	return u.currentnode
+}
+
+// setStatus updates one section of the status line, sections are shown in
+// the order they were first set
+func (u *MainUI) setStatus(key, text string) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	if _, ok := u.statuses[key]; !ok {
+		u.statuskeys = append(u.statuskeys, key)
+	}
+	u.statuses[key] = text
+
+	parts := make([]string, 0, len(u.statuskeys))
+	for _, k := range u.statuskeys {
+		parts = append(parts, u.statuses[k])
+	}
+	u.status.SetText(strings.Join(parts, " | "))
+}
+
 func (u *MainUI) populateList(r []apiname) {
 	u.defineNodes(r)
+	history.setNames(u.aliases)
 	aliasKeys := sortAliasKeys(u.aliases)
 	for _, a := range aliasKeys {
 		s := -1
 		anode := &node{"", []string{}, &s}
+		history.restore(anode, historyKey(u.aliases[a]))
 		u.nodes[*u.aliases[a].Name] = anode
 
 		name := *u.aliases[a].Name
 		u.list.AddOption(*u.aliases[a].Name, func() {
-			u.cli.SetText("")
-			u.currentnode = name
-			u.cliresult.SetText(u.nodes[name].Buff)
-			app.SetFocus(u.cli)
+			u.selectNode(name)
 		})
 	}
 
-	confcmd := fmt.Sprintf("bitcoin-cli -conf=%s//.lndev/bitcoin/bitcoin.conf", userdir)
-	name := "Regtest"
-	u.aliases[name] = &alias{&name, &confcmd, 0, ""}
-	s := -1
-	anode := &node{"", []string{}, &s}
-	u.nodes[name] = anode
+	for _, b := range backends {
+		name := b.String()
+		confcmd := fmt.Sprintf("bitcoin-cli -conf=%s", b.conf())
+		if b.N == 0 {
+			confcmd += " -rpcwallet=" + BITCOIN_WALLET
+		}
+		u.aliases[name] = &alias{&name, &confcmd, 0, ""}
+		s := -1
+		anode := &node{"", []string{}, &s}
+		history.restore(anode, historyKey(u.aliases[name]))
+		u.nodes[name] = anode
 
-	u.list.AddOption(name, func() {
-		u.cli.SetText("")
-		u.currentnode = name
-		u.cliresult.SetText(u.nodes[name].Buff)
-		app.SetFocus(u.cli)
-	})
+		u.list.AddOption(name, func() {
+			u.selectNode(name)
+		})
+	}
 	u.list.AddOption("Quit", func() {
 		// kill bitcoind
-		cmd := exec.Command("bitcoin-cli", fmt.Sprintf("-conf=%s//.lndev/bitcoin/bitcoin.conf", userdir), "stop")
-		cmd.Run()
+		shutdownErr = stopBackends()
 
-		for i := 1; i < len(u.aliases); i++ {
-			host := fmt.Sprintf("--rpcserver=localhost:%d", BASE_PORT+i)
-			macaroon := fmt.Sprintf("--macaroonpath=%s/.lndev/user%d/data/chain/bitcoin/regtest/admin.macaroon", userdir, i)
+		for _, a := range u.aliases {
+			if a.Port == 0 {
+				continue
+			}
+			host := fmt.Sprintf("--rpcserver=localhost:%d", a.Port)
+			macaroon := fmt.Sprintf("--macaroonpath=%s", a.MacaroonPath)
 			cmd := exec.Command("lncli", host, macaroon, "stop")
 			cmd.Run()
 		}
@@ -197,44 +369,60 @@ func (u *MainUI) populateList(r []apiname) {
 }
 
 func (u *MainUI) defineNodes(r []apiname) {
-	tmpl, _ := template.New("view").Parse(configtemplate)
-	for i, n := range r {
-		var b bytes.Buffer
-		name := n.Name.Last
-		mac := fmt.Sprintf("%s/.lndev/user%d/data/chain/bitcoin/regtest/admin.macaroon", userdir, i+1)
-		view := &cfgview{}
-		view.N = i + 1
-		view.Rpc = view.N + BASE_PORT
-		view.Listen = view.N + BASE_PORT + 1000
-		view.Rest = view.N + BASE_PORT + 2000
-		view.Macaroon = mac
-		view.Name = n.Name.Last
-		view.User = userdir
-		err := tmpl.Execute(&b, view)
-		if err != nil {
+	bitcoindVersion = detectBitcoind()
+	count, _ := strconv.Atoi(nBackends)
+	backends = NewBackends(count)
+	for _, b := range backends {
+		if err := b.writeConf(); err != nil {
 			panic(err)
 		}
-		cmd := fmt.Sprintf("lncli --rpcserver=localhost:%d --macaroonpath=%s/.lndev/user%d/data/chain/bitcoin/regtest/admin.macaroon", BASE_PORT+i+1, userdir, i+1)
-		u.aliases[n.Name.Last] = &alias{&name, &cmd, BASE_PORT + i + 1, mac}
+	}
 
-		udir := fmt.Sprintf("%s/.lndev/user%d", userdir, i+1)
-		ensureDir(udir)
+	for i, n := range r {
+		name := n.Name.Last
+		for _, f := range channelFeatures(chanType) {
+			addFeature(name, f)
+		}
+		view := nodeView(i+1, name)
+		cmd := fmt.Sprintf("lncli --rpcserver=localhost:%d --macaroonpath=%s", view.Rpc, view.Macaroon)
+		u.aliases[name] = &alias{&name, &cmd, view.Rpc, view.Macaroon}
 
-		f, err := os.Create(fmt.Sprintf("%s/.lndev/user%d/lnd.conf", userdir, i+1))
-		if err != nil {
+		ensureDir(fmt.Sprintf("%s/.lndev/user%d", userdir, view.N))
+		if err := writeLndConf(view); err != nil {
 			panic(err)
 		}
-		defer f.Close()
-		_, err = f.Write(b.Bytes())
-
 	}
-	f, err := os.Create(fmt.Sprintf("%s/.lndev/bitcoin/bitcoin.conf", userdir))
+}
+
+// nodeView lays out the ports and paths of the n-th lnd node
+func nodeView(n int, name string) *cfgview {
+	view := &cfgview{}
+	view.N = n
+	view.Rpc = view.N + BASE_PORT
+	view.Listen = view.N + BASE_PORT + 1000
+	view.Rest = view.N + BASE_PORT + 2000
+	view.Tower = view.N + BASE_PORT + 3000
+	view.Macaroon = fmt.Sprintf("%s/.lndev/user%d/data/chain/bitcoin/regtest/admin.macaroon", userdir, n)
+	view.Name = name
+	view.User = userdir
+	view.RPCUser = BITCOIN_RPC_USER
+	view.RPCPass = BITCOIN_RPC_PASS
+	view.Backend = backendFor(n, name)
+	view.Watchtower = hasFeature(name, FEATURE_WATCHTOWER)
+	view.Wtclient = hasFeature(name, FEATURE_WTCLIENT)
+	view.ScidAlias = hasFeature(name, FEATURE_SCID_ALIAS)
+	view.ZeroConf = hasFeature(name, FEATURE_ZERO_CONF)
+	return view
+}
+
+func writeLndConf(view *cfgview) error {
+	tmpl, err := template.New("view").Parse(configtemplate)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	tmpl, _ = template.New("bitcoin").Parse(bitcoinconf)
 	var b bytes.Buffer
-	err = tmpl.Execute(&b, userdir)
-	defer f.Close()
-	_, err = f.Write(b.Bytes())
+	if err := tmpl.Execute(&b, view); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fmt.Sprintf("%s/.lndev/user%d/lnd.conf", userdir, view.N), b.Bytes(), 0644)
 }